@@ -7,67 +7,215 @@ package bfrt
 
 import (
 	"context"
-	"fmt"
+	"sync"
+	"time"
+
 	"github.com/P4Networking/proto/go/p4"
+	"google.golang.org/grpc"
+)
+
+var (
+	bfrtClientsLock sync.Mutex
+	bfrtClients     = make(map[bfrtClientKey]BFRuntimeClient)
+	// Number of users of each cached client
+	bfrtClientRefs = make(map[bfrtClientKey]int)
+	// Clients being created, so that concurrent callers share a single client
+	bfrtClientCalls = make(map[bfrtClientKey]*clientCall)
 )
 
-var bfrtClients = make(map[bfrtClientKey]BFRuntimeClient)
+type clientCall struct {
+	done   chan struct{}
+	client BFRuntimeClient
+	err    error
+}
+
+// ClientOptions describes the client returned by NewBFRuntimeClient.
+type ClientOptions struct {
+	Host       string
+	DeviceId   uint32
+	ClientId   uint32 // the client's role; clients with different IDs are never shared
+	P4Name     string
+	BatchSize  int
+	NumThreads int
+	// NoCache opens a client with its own gRPC connection, neither taken from nor
+	// added to the cache, e.g. to run several controllers against the same switch
+	NoCache bool
+}
 
 type BFRuntimeClient interface {
 	SetMastership(clientId uint32) error
+	SetMastershipContext(ctx context.Context, clientId uint32) error
 	GetForwardingPipelineConfig() ([]*p4.ForwardingPipelineConfig, error)
+	GetForwardingPipelineConfigContext(ctx context.Context) ([]*p4.ForwardingPipelineConfig, error)
 	SetForwardingPipelineConfig() error
+	SetForwardingPipelineConfigContext(ctx context.Context) error
+	PushPipelineConfig(action p4.SetForwardingPipelineConfigRequest_Action, program *Program) (PipelinePush, error)
+	PushPipelineConfigContext(ctx context.Context, action p4.SetForwardingPipelineConfigRequest_Action, program *Program) (PipelinePush, error)
+	UpdatePipelineConfig(action p4.SetForwardingPipelineConfigRequest_Action, program *Program, forcePush bool) (bool, PipelinePush, error)
+	UpdatePipelineConfigContext(ctx context.Context, action p4.SetForwardingPipelineConfigRequest_Action, program *Program, forcePush bool) (bool, PipelinePush, error)
+	SetPipelineBasePath(basePath string)
 	Write(req *p4.WriteRequest) <-chan []*p4.Error
+	WriteContext(ctx context.Context, req *p4.WriteRequest) <-chan []*p4.Error
+	ReadTableUsage(tableId uint32) (uint32, error)
+	ReadTableUsageContext(ctx context.Context, tableId uint32) (uint32, error)
+	IsMaster() bool
+	WaitForMastership(ctx context.Context) error
 	SetWriteTraceChan(traceChan chan WriteTrace)
+	SetEventChan(eventChan chan Event)
+	SubscribeDigests(p4info *P4InfoHelper, digestChan chan Digest)
+	SetIdleTimeoutChan(idleTimeoutChan chan IdleTimeout)
+	SetPortStatusChan(portStatusChan chan PortStatus)
+	SetStreamErrorChan(errorChan chan StreamError)
+	EnableIdleTimeoutNotifications(ctx context.Context, tableId uint32, queryInterval, minTTL, maxTTL time.Duration) error
+	SetReconnectBackoff(min, max time.Duration)
+	StreamStats() []StreamStats
+	SetRPCTimeout(timeout time.Duration)
+	SetWriteTimeout(timeout time.Duration)
 	ClientId() uint32
 	DeviceID() uint32
+	Close() error
 }
 
 type bfrtClientKey struct {
 	host     string
 	deviceId uint32
+	clientId uint32
 }
 
 type bfrtClient struct {
 	client         p4.BfRuntimeClient
 	stream         p4.BfRuntime_StreamChannelClient
+	conn           *grpc.ClientConn
+	host           string
 	clientId       uint32
 	deviceId       uint32
-	p4Name         string
 	writes         chan p4Write
 	writeTraceChan chan WriteTrace
+	eventChan      chan Event
 	batchSize      int
 	numThreads     int
+	rpcTimeout     time.Duration // applied to unary RPCs without a deadline
+	writeTimeout   time.Duration // applied to each Write RPC without a deadline
+
+	idleTimeoutChan chan IdleTimeout
+	portStatusChan  chan PortStatus
+	streamErrorChan chan StreamError
+
+	pipelineBasePath string // directory the switch saves pushed programs in
+
+	minReconnectBackoff time.Duration
+	maxReconnectBackoff time.Duration
+
+	// streamLock guards the stream, which is replaced on reconnection, and the
+	// state needed to restore the session on the new stream
+	streamLock      sync.Mutex
+	streamCancel    context.CancelFunc
+	mastershipReq   *p4.StreamMessageRequest
+	p4Name          string // program the client binds to
+	pipelineBound   bool
+	restorePipeline bool
+	digestInfo      *P4InfoHelper
+	digestChan      chan Digest
+	pipelineDone    chan struct{} // set while a push is in progress; signalled when warm init finishes
+
+	masterLock sync.Mutex
+	master     bool
+	masterChan chan struct{} // closed while the client is master
+
+	cached       bool            // conn and client are shared through the caches
+	key          bfrtClientKey   // key of the client in the cache
+	ctx          context.Context // cancelled by Close; parent of the stream
+	cancel       context.CancelFunc
+	closeLock    sync.RWMutex // held for reading while a write is being queued
+	closed       bool
+	writers      sync.WaitGroup
+	receiverDone chan struct{}
+	dispatcher   *dispatcher // routes the messages received by receiveStream
 }
 
 func (c *bfrtClient) Init(p4Name string) (err error) {
 	c.p4Name = p4Name
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	// Initialize stream for mastership and packet I/O
-	c.stream, err = c.client.StreamChannel(context.Background())
+	err = c.openStream()
 	if err != nil {
+		c.cancel()
 		return
 	}
-	go func() {
-		for {
-			_, err := c.stream.Recv()
-			if err != nil {
-				fmt.Printf("stream recv error: %v\n", err)
-			} else {
-				fmt.Println("client is master")
-			}
-		}
-	}()
+	c.masterChan = make(chan struct{})
+	c.receiverDone = make(chan struct{})
+	c.registerHandlers()
+	go c.receiveStream()
 
 	var writeBufferSize = c.batchSize * c.numThreads * 10
 	// Initialize Write thread
 	c.writes = make(chan p4Write, writeBufferSize)
 	for i := 0; i < c.numThreads; i++ {
+		c.writers.Add(1)
 		go c.ListenForWrites()
 	}
 
 	return
 }
 
+// Close stops accepting writes, waits for the queued writes to complete and closes the
+// stream. The gRPC connection is closed once no other client is using it. A cached
+// client is only closed when the last of its users closes it.
+func (c *bfrtClient) Close() (err error) {
+	if c.cached && !c.release() {
+		return
+	}
+
+	c.closeLock.Lock()
+	if c.closed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.writes)
+	c.closeLock.Unlock()
+
+	// Let the write threads drain the queue
+	c.writers.Wait()
+
+	c.streamLock.Lock()
+	err = c.stream.CloseSend()
+	c.streamLock.Unlock()
+	c.cancel()
+	<-c.receiverDone
+	c.dispatcher.stop()
+
+	if releaseErr := c.releaseConnection(); err == nil {
+		err = releaseErr
+	}
+	return
+}
+
+// release gives up one reference to a cached client, returning true when it was the
+// last one. The client is then removed from the cache, so it is not handed out again.
+func (c *bfrtClient) release() bool {
+	bfrtClientsLock.Lock()
+	defer bfrtClientsLock.Unlock()
+	if client, ok := bfrtClients[c.key]; !ok || client != c {
+		// Already released by its last user
+		return true
+	}
+	bfrtClientRefs[c.key]--
+	if bfrtClientRefs[c.key] > 0 {
+		return false
+	}
+	delete(bfrtClients, c.key)
+	delete(bfrtClientRefs, c.key)
+	return true
+}
+
+func (c *bfrtClient) releaseConnection() error {
+	if c.cached {
+		return ReleaseConnection(c.host)
+	}
+	return c.conn.Close()
+}
+
 func (c *bfrtClient) ClientId() uint32 {
 	return c.clientId
 }
@@ -76,33 +224,130 @@ func (c *bfrtClient) DeviceID() uint32 {
 	return c.deviceId
 }
 
+func (c *bfrtClient) SetRPCTimeout(timeout time.Duration) {
+	c.rpcTimeout = timeout
+}
+
+func (c *bfrtClient) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// withTimeout bounds ctx by timeout, unless ctx already has a deadline or timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func CreateOrGetBFRuntimeClient(host string, deviceId uint32, batchSize int, numThreads int, p4Name string) (BFRuntimeClient, error) {
+	return CreateOrGetBFRuntimeClientContext(context.Background(), host, deviceId, batchSize, numThreads, p4Name)
+}
+
+// CreateOrGetBFRuntimeClientContext is like CreateOrGetBFRuntimeClient, but gives up
+// dialing the switch when ctx is done.
+func CreateOrGetBFRuntimeClientContext(ctx context.Context, host string, deviceId uint32, batchSize int, numThreads int, p4Name string) (BFRuntimeClient, error) {
+	return NewBFRuntimeClient(ctx, ClientOptions{
+		Host:       host,
+		DeviceId:   deviceId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+}
+
+// NewBFRuntimeClient returns the cached client for the host, device and client ID in
+// opts, creating it if needed. It is safe to call from multiple goroutines.
+// Every call must be paired with a call to Close on the returned client.
+func NewBFRuntimeClient(ctx context.Context, opts ClientOptions) (BFRuntimeClient, error) {
+	if opts.NoCache {
+		return newBFRuntimeClient(ctx, opts)
+	}
 
 	key := bfrtClientKey{
-		host:     host,
-		deviceId: deviceId,
+		host:     opts.Host,
+		deviceId: opts.DeviceId,
+		clientId: opts.ClientId,
 	}
 
-	// First, return a P4RT client if one exists
-	if p4rtClient, ok := bfrtClients[key]; ok {
-		return p4rtClient, nil
+	// First, return a BFRT client if one exists or is being created
+	bfrtClientsLock.Lock()
+	for {
+		if client, ok := bfrtClients[key]; ok {
+			bfrtClientRefs[key]++
+			bfrtClientsLock.Unlock()
+			return client, nil
+		}
+		call, ok := bfrtClientCalls[key]
+		if !ok {
+			break
+		}
+		// Another caller is creating the client; wait for it and check the cache again
+		bfrtClientsLock.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil && (!isContextError(call.err) || ctx.Err() != nil) {
+			return nil, call.err
+		}
+		// If the creator gave up on its own context, ours may still be live: create
+		// the client again
+		bfrtClientsLock.Lock()
 	}
+	call := &clientCall{done: make(chan struct{})}
+	bfrtClientCalls[key] = call
+	bfrtClientsLock.Unlock()
+
+	// Second, create a new BFRT client, reusing the gRPC connection if possible
+	call.client, call.err = newBFRuntimeClient(ctx, opts)
 
-	// Second, check to see if we can reuse the gRPC connection for a new P4RT client
-	conn, err := GetConnection(host)
+	bfrtClientsLock.Lock()
+	delete(bfrtClientCalls, key)
+	if call.err == nil {
+		bfrtClients[key] = call.client
+		bfrtClientRefs[key] = 1
+	}
+	bfrtClientsLock.Unlock()
+	close(call.done)
+	return call.client, call.err
+}
+
+func newBFRuntimeClient(ctx context.Context, opts ClientOptions) (BFRuntimeClient, error) {
+	var conn *grpc.ClientConn
+	var err error
+	if opts.NoCache {
+		conn, err = Dial(ctx, opts.Host)
+	} else {
+		conn, err = GetConnectionContext(ctx, opts.Host)
+	}
 	if err != nil {
 		return nil, err
 	}
 	client := &bfrtClient{
 		client:     p4.NewBfRuntimeClient(conn),
-		deviceId:   deviceId,
-		batchSize:  batchSize,
-		numThreads: numThreads,
+		conn:       conn,
+		host:       opts.Host,
+		clientId:   opts.ClientId,
+		deviceId:   opts.DeviceId,
+		batchSize:  opts.BatchSize,
+		numThreads: opts.NumThreads,
+
+		minReconnectBackoff: defaultMinReconnectBackoff,
+		maxReconnectBackoff: defaultMaxReconnectBackoff,
+
+		cached: !opts.NoCache,
+		key: bfrtClientKey{
+			host:     opts.Host,
+			deviceId: opts.DeviceId,
+			clientId: opts.ClientId,
+		},
 	}
-	err = client.Init(p4Name)
+	err = client.Init(opts.P4Name)
 	if err != nil {
+		client.releaseConnection()
 		return nil, err
 	}
-	bfrtClients[key] = client
 	return client, nil
 }
@@ -7,14 +7,30 @@ package bfrt
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
-// Cache of address to gRPC client
-var grpcClients = make(map[string]*grpc.ClientConn)
+var (
+	grpcClientsLock sync.Mutex
+	// Cache of address to gRPC client
+	grpcClients = make(map[string]*grpc.ClientConn)
+	// Number of users of each cached gRPC client
+	grpcClientRefs = make(map[string]int)
+	// Dials in progress, so that concurrent callers share a single connection
+	grpcDials = make(map[string]*dialCall)
+)
+
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
 
 func MonitorConnection(conn *grpc.ClientConn) {
 	state := conn.GetState()
@@ -28,17 +44,100 @@ func MonitorConnection(conn *grpc.ClientConn) {
 	}
 }
 
+// GetConnection returns the shared gRPC connection to host, dialing it if needed.
+// Every call must be paired with a call to ReleaseConnection.
 func GetConnection(host string) (conn *grpc.ClientConn, err error) {
-	conn, ok := grpcClients[host]
-	if !ok {
-		conn, err = grpc.Dial(host, grpc.WithInsecure(),
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(128*1024*1024),
-				grpc.MaxCallSendMsgSize(128*1024*1024)))
-		if err != nil {
-			return nil, err
+	return GetConnectionContext(context.Background(), host)
+}
+
+// GetConnectionContext is like GetConnection, but if ctx has a deadline, it blocks
+// until the connection is up and fails once the deadline passes.
+func GetConnectionContext(ctx context.Context, host string) (*grpc.ClientConn, error) {
+	grpcClientsLock.Lock()
+	for {
+		if conn, ok := grpcClients[host]; ok {
+			grpcClientRefs[host]++
+			grpcClientsLock.Unlock()
+			return conn, nil
+		}
+		call, ok := grpcDials[host]
+		if !ok {
+			break
+		}
+		// Another caller is dialing the host; wait for it and check the cache again
+		grpcClientsLock.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		if call.err != nil && (!isContextError(call.err) || ctx.Err() != nil) {
+			return nil, call.err
+		}
+		// If the dial gave up on its caller's context, ours may still be live: dial again
+		grpcClientsLock.Lock()
+	}
+	call := &dialCall{done: make(chan struct{})}
+	grpcDials[host] = call
+	grpcClientsLock.Unlock()
+
+	conn, err := Dial(ctx, host)
+
+	grpcClientsLock.Lock()
+	delete(grpcDials, host)
+	if err == nil {
 		grpcClients[host] = conn
+		grpcClientRefs[host] = 1
 		go MonitorConnection(conn)
 	}
-	return
+	grpcClientsLock.Unlock()
+	call.err = err
+	close(call.done)
+	return conn, err
+}
+
+// Dial opens a new gRPC connection to host which is not shared through the cache.
+// If ctx has a deadline, it blocks until the connection is up.
+func Dial(ctx context.Context, host string) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(128*1024*1024),
+			grpc.MaxCallSendMsgSize(128*1024*1024))}
+	if _, ok := ctx.Deadline(); ok {
+		opts = append(opts, grpc.WithBlock())
+	}
+	return grpc.DialContext(ctx, host, opts...)
+}
+
+// ReleaseConnection gives up one reference to the connection to host, closing it
+// when the last reference is released.
+func ReleaseConnection(host string) error {
+	grpcClientsLock.Lock()
+	conn, ok := grpcClients[host]
+	if !ok {
+		grpcClientsLock.Unlock()
+		return nil
+	}
+	grpcClientRefs[host]--
+	if grpcClientRefs[host] > 0 {
+		grpcClientsLock.Unlock()
+		return nil
+	}
+	delete(grpcClients, host)
+	delete(grpcClientRefs, host)
+	grpcClientsLock.Unlock()
+	return conn.Close()
+}
+
+// isContextError reports whether err comes from a cancelled or expired context. Such
+// errors belong to the caller whose context it was, so they are not shared with the
+// callers waiting on the same dial or client.
+func isContextError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	}
+	return false
 }
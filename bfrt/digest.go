@@ -0,0 +1,98 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// Digest is a DigestList decoded with the learn filter's field names.
+type Digest struct {
+	Filter   string
+	DigestId uint32
+	ListId   uint32
+	Target   *p4.TargetDevice
+	Entries  []map[string][]byte // one map of field name to value per learned entry
+	Received time.Time
+}
+
+// SubscribeDigests delivers the digests received on the stream to digestChan,
+// decoded using the learn filters in p4info. Every digest list is acknowledged,
+// even if digestChan is full and the digest is discarded.
+func (c *bfrtClient) SubscribeDigests(p4info *P4InfoHelper, digestChan chan Digest) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	c.digestInfo = p4info
+	c.digestChan = digestChan
+}
+
+func (c *bfrtClient) handleDigest(digestList *p4.DigestList) {
+	received := time.Now()
+	c.streamLock.Lock()
+	p4info, digestChan := c.digestInfo, c.digestChan
+	c.streamLock.Unlock()
+
+	if digestChan != nil {
+		digest, err := decodeDigest(p4info, digestList)
+		if err != nil {
+			fmt.Printf("digest decode error: %v\n", err)
+		} else {
+			digest.Received = received
+			select {
+			case digestChan <- digest: // put digest into the channel unless it is full
+			default:
+				fmt.Println("Digest channel full. Discarding digest")
+			}
+		}
+	}
+
+	ack := &p4.StreamMessageRequest{
+		Update: &p4.StreamMessageRequest_DigestAck{
+			DigestAck: &p4.DigestListAck{
+				DigestId: digestList.GetDigestId(),
+				ListId:   digestList.GetListId(),
+			},
+		},
+	}
+	if err := c.send(ack); err != nil {
+		fmt.Printf("digest ack error: %v\n", err)
+	}
+}
+
+func decodeDigest(p4info *P4InfoHelper, digestList *p4.DigestList) (digest Digest, err error) {
+	filter, err := p4info.GetLearnFilter(digestList.GetDigestId())
+	if err != nil {
+		return
+	}
+	names := make(map[uint32]string, len(filter.Fields))
+	for _, field := range filter.Fields {
+		names[field.ID] = field.Name
+	}
+
+	digest = Digest{
+		Filter:   filter.Name,
+		DigestId: digestList.GetDigestId(),
+		ListId:   digestList.GetListId(),
+		Target:   digestList.GetTarget(),
+		Entries:  make([]map[string][]byte, len(digestList.GetData())),
+	}
+	for i, data := range digestList.GetData() {
+		entry := make(map[string][]byte, len(data.GetFields()))
+		for _, field := range data.GetFields() {
+			name, ok := names[field.GetFieldId()]
+			if !ok {
+				err = fmt.Errorf("unknown field %d in learn filter %s", field.GetFieldId(), filter.Name)
+				return
+			}
+			entry[name] = field.GetStream()
+		}
+		digest.Entries[i] = entry
+	}
+	return
+}
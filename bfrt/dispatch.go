@@ -0,0 +1,152 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// Kinds of messages received on the stream, one per StreamMessageResponse update
+const (
+	SubscribeMessage      = "subscribe"
+	DigestMessage         = "digest"
+	IdleTimeoutMessage    = "idle_timeout_notification"
+	PortStatusMessage     = "port_status_change_notification"
+	PipelineConfigMessage = "set_forwarding_pipeline_config_response"
+	ErrorMessage          = "error"
+	UnknownMessage        = "unknown"
+)
+
+// Messages of each kind queued for their handler before new ones are dropped
+const defaultDispatchBufferSize = 1000
+
+// StreamStats counts the messages of one kind received on the stream.
+type StreamStats struct {
+	Kind     string
+	Received uint64
+	Dropped  uint64 // discarded because the handler fell behind
+}
+
+type streamHandler func(res *p4.StreamMessageResponse)
+
+// route delivers one kind of message to its handler. Messages are queued for a
+// goroutine of their own, unless the route has no buffer, in which case they are
+// handled by the receiving goroutine, in order with stream failures.
+type route struct {
+	received uint64 // first, to be 64-bit aligned for atomic access
+	dropped  uint64
+	kind     string
+	handler  streamHandler
+	messages chan *p4.StreamMessageResponse
+}
+
+// dispatcher routes the messages received on the stream to the handlers registered
+// for their kind, so that a slow handler only holds back messages of its own kind.
+type dispatcher struct {
+	lock    sync.Mutex
+	routes  map[string]*route
+	workers sync.WaitGroup
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{routes: make(map[string]*route)}
+}
+
+// handle registers handler for messages of kind, buffering up to bufferSize of them.
+// Messages arriving while the buffer is full are dropped and counted.
+func (d *dispatcher) handle(kind string, bufferSize int, handler streamHandler) {
+	r := &route{kind: kind, handler: handler}
+	if bufferSize > 0 {
+		r.messages = make(chan *p4.StreamMessageResponse, bufferSize)
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			for res := range r.messages {
+				r.handler(res)
+			}
+		}()
+	}
+	d.lock.Lock()
+	d.routes[kind] = r
+	d.lock.Unlock()
+}
+
+// dispatch hands res to the handler of its kind, or prints it if there is none.
+func (d *dispatcher) dispatch(res *p4.StreamMessageResponse) {
+	kind := messageKind(res)
+	d.lock.Lock()
+	r, ok := d.routes[kind]
+	d.lock.Unlock()
+	if !ok {
+		fmt.Printf("stream recv: %v\n", res)
+		return
+	}
+
+	atomic.AddUint64(&r.received, 1)
+	if r.messages == nil {
+		r.handler(res)
+		return
+	}
+	select {
+	case r.messages <- res: // put message into the channel unless it is full
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+		fmt.Printf("%s channel full. Discarding %s\n", kind, kind)
+	}
+}
+
+// stop waits for the queued messages to be handled. No message may be dispatched
+// once stop is called.
+func (d *dispatcher) stop() {
+	d.lock.Lock()
+	for _, r := range d.routes {
+		if r.messages != nil {
+			close(r.messages)
+		}
+	}
+	d.lock.Unlock()
+	d.workers.Wait()
+}
+
+// stats returns the counters of every registered kind, sorted by kind.
+func (d *dispatcher) stats() []StreamStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stats := make([]StreamStats, 0, len(d.routes))
+	for _, r := range d.routes {
+		stats = append(stats, StreamStats{
+			Kind:     r.kind,
+			Received: atomic.LoadUint64(&r.received),
+			Dropped:  atomic.LoadUint64(&r.dropped),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Kind < stats[j].Kind })
+	return stats
+}
+
+func messageKind(res *p4.StreamMessageResponse) string {
+	switch res.GetUpdate().(type) {
+	case *p4.StreamMessageResponse_Subscribe:
+		return SubscribeMessage
+	case *p4.StreamMessageResponse_Digest:
+		return DigestMessage
+	case *p4.StreamMessageResponse_IdleTimeoutNotification:
+		return IdleTimeoutMessage
+	case *p4.StreamMessageResponse_PortStatusChangeNotification:
+		return PortStatusMessage
+	case *p4.StreamMessageResponse_SetForwardingPipelineConfigResponse:
+		return PipelineConfigMessage
+	case *p4.StreamMessageResponse_Error:
+		return ErrorMessage
+	default:
+		return UnknownMessage
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// IdleTimeout reports a table entry which aged out.
+type IdleTimeout struct {
+	Target   *p4.TargetDevice
+	Entry    *p4.TableEntry
+	Received time.Time
+}
+
+func (c *bfrtClient) SetIdleTimeoutChan(idleTimeoutChan chan IdleTimeout) {
+	c.idleTimeoutChan = idleTimeoutChan
+}
+
+func (c *bfrtClient) handleIdleTimeout(notification *p4.IdleTimeoutNotification) {
+	if c.idleTimeoutChan == nil {
+		return
+	}
+	idleTimeout := IdleTimeout{
+		Target:   notification.GetTarget(),
+		Entry:    notification.GetTableEntry(),
+		Received: time.Now(),
+	}
+	select {
+	case c.idleTimeoutChan <- idleTimeout: // put notification into the channel unless it is full
+	default:
+		fmt.Println("Idle timeout channel full. Discarding notification")
+	}
+}
+
+// EnableIdleTimeoutNotifications makes the switch age out the entries of a table and
+// notify the client. Entries then need a $ENTRY_TTL between minTTL and maxTTL; the
+// switch checks their age every queryInterval.
+func (c *bfrtClient) EnableIdleTimeoutNotifications(ctx context.Context, tableId uint32, queryInterval, minTTL, maxTTL time.Duration) error {
+	req := &p4.WriteRequest{
+		ClientId: c.clientId,
+		Target: &p4.TargetDevice{
+			DeviceId: c.deviceId,
+			PipeId:   0xffff,
+		},
+		Updates: []*p4.Update{{
+			Type: p4.Update_INSERT,
+			Entity: &p4.Entity{Entity: &p4.Entity_TableAttribute{
+				TableAttribute: &p4.TableAttribute{
+					TableId: tableId,
+					Attribute: &p4.TableAttribute_IdleTable{
+						IdleTable: &p4.IdleTable{
+							TtlQueryInterval: uint32(queryInterval.Milliseconds()),
+							MinTtl:           uint32(minTTL.Milliseconds()),
+							MaxTtl:           uint32(maxTTL.Milliseconds()),
+							IdleTableMode:    p4.IdleTable_IDLE_TABLE_NOTIFY_MODE,
+							Enable:           true,
+						},
+					},
+				},
+			}},
+		}},
+	}
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	_, err := c.client.Write(ctx, req)
+	return err
+}
@@ -6,11 +6,26 @@
 package bfrt
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/P4Networking/proto/go/p4"
+	"google.golang.org/grpc/status"
 )
 
 func (c *bfrtClient) SetMastership(clientId uint32) (err error) {
-	c.clientId = clientId
+	return c.SetMastershipContext(context.Background(), clientId)
+}
+
+// SetMastershipContext subscribes the client as master. Stream sends cannot be
+// cancelled: if ctx is done first, it returns the context's error, but the
+// subscription may still be sent afterwards. The client ID cannot change: it keys the
+// client in the cache and is sent with every request, so clientId must be the ID the
+// client was created with.
+func (c *bfrtClient) SetMastershipContext(ctx context.Context, clientId uint32) (err error) {
+	if clientId != c.clientId {
+		return fmt.Errorf("client ID %d differs from the ID %d the client was created with", clientId, c.clientId)
+	}
 
 	mastershipReq := &p4.StreamMessageRequest{
 		Update: &p4.StreamMessageRequest_Subscribe{
@@ -26,6 +41,58 @@ func (c *bfrtClient) SetMastership(clientId uint32) (err error) {
 		},
 	}
 
-	err = c.stream.Send(mastershipReq)
+	// Remember the request, so the subscription can be restored after reconnecting
+	c.streamLock.Lock()
+	c.mastershipReq = mastershipReq
+	c.streamLock.Unlock()
+
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	// Stream sends cannot be cancelled, so give up waiting on the send instead
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.send(mastershipReq)
+	}()
+	select {
+	case err = <-sent:
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	}
 	return
 }
+
+// IsMaster returns whether the switch last confirmed this client as master.
+func (c *bfrtClient) IsMaster() bool {
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	return c.master
+}
+
+// WaitForMastership blocks until the switch confirms this client as master, or ctx is done.
+func (c *bfrtClient) WaitForMastership(ctx context.Context) error {
+	c.masterLock.Lock()
+	masterChan := c.masterChan
+	c.masterLock.Unlock()
+	select {
+	case <-masterChan:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// setMaster records whether the client is master, returning true if that changed.
+func (c *bfrtClient) setMaster(master bool) bool {
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	if c.master == master {
+		return false
+	}
+	c.master = master
+	if master {
+		close(c.masterChan)
+	} else {
+		c.masterChan = make(chan struct{})
+	}
+	return true
+}
@@ -14,6 +14,61 @@ import (
 type P4InfoHelper struct {
 	nameToP4ID map[string]uint32 // P4 name to P4 ID.
 
+	info         BfRtInfo
+	tables       map[string]*TableInfo       // table name to table
+	learnFilters map[uint32]*LearnFilterInfo // learn filter ID to learn filter
+}
+
+// BfRtInfo is the part of bfrt.json needed beyond names and IDs.
+type BfRtInfo struct {
+	Tables       []TableInfo       `json:"tables"`
+	LearnFilters []LearnFilterInfo `json:"learn_filters"`
+}
+
+type TableInfo struct {
+	Name        string       `json:"name"`
+	ID          uint32       `json:"id"`
+	TableType   string       `json:"table_type"`
+	Size        int64        `json:"size"`
+	Key         []KeyInfo    `json:"key"`
+	ActionSpecs []ActionInfo `json:"action_specs"`
+	Data        []DataInfo   `json:"data"` // data fields common to all actions, e.g. $ENTRY_TTL
+}
+
+type KeyInfo struct {
+	ID        uint32   `json:"id"`
+	Name      string   `json:"name"`
+	MatchType string   `json:"match_type"`
+	Type      TypeInfo `json:"type"`
+}
+
+type ActionInfo struct {
+	ID   uint32      `json:"id"`
+	Name string      `json:"name"`
+	Data []FieldInfo `json:"data"`
+}
+
+type DataInfo struct {
+	Mandatory bool      `json:"mandatory"`
+	ReadOnly  bool      `json:"read_only"`
+	Singleton FieldInfo `json:"singleton"`
+}
+
+type LearnFilterInfo struct {
+	Name   string      `json:"name"`
+	ID     uint32      `json:"id"`
+	Fields []FieldInfo `json:"fields"`
+}
+
+type FieldInfo struct {
+	ID   uint32   `json:"id"`
+	Name string   `json:"name"`
+	Type TypeInfo `json:"type"`
+}
+
+type TypeInfo struct {
+	Type  string `json:"type"`
+	Width int    `json:"width"`
 }
 
 func (p4infoHelper *P4InfoHelper) Init(config []byte) (err error) {
@@ -21,6 +76,10 @@ func (p4infoHelper *P4InfoHelper) Init(config []byte) (err error) {
 	if err != nil {
 		return err
 	}
+	err = json.Unmarshal(config, &p4infoHelper.info)
+	if err != nil {
+		return err
+	}
 
 	p4infoHelper.nameToP4ID = make(map[string]uint32)
 
@@ -30,6 +89,18 @@ func (p4infoHelper *P4InfoHelper) Init(config []byte) (err error) {
 			p4infoHelper.nameToP4ID[action.Name] = uint32(action.ID)
 		}
 	}
+
+	p4infoHelper.tables = make(map[string]*TableInfo)
+	for i := range p4infoHelper.info.Tables {
+		table := &p4infoHelper.info.Tables[i]
+		p4infoHelper.tables[table.Name] = table
+	}
+	p4infoHelper.learnFilters = make(map[uint32]*LearnFilterInfo)
+	for i := range p4infoHelper.info.LearnFilters {
+		filter := &p4infoHelper.info.LearnFilters[i]
+		p4infoHelper.nameToP4ID[filter.Name] = filter.ID
+		p4infoHelper.learnFilters[filter.ID] = filter
+	}
 	return
 }
 
@@ -40,3 +111,61 @@ func (p4infoHelper *P4InfoHelper) GetP4Id(name string) (p4ID uint32, err error)
 	}
 	return
 }
+
+func (p4infoHelper *P4InfoHelper) GetTable(name string) (table *TableInfo, err error) {
+	table, exists := p4infoHelper.tables[name]
+	if !exists {
+		err = fmt.Errorf("Unable to find table %s", name)
+	}
+	return
+}
+
+func (p4infoHelper *P4InfoHelper) GetLearnFilter(id uint32) (filter *LearnFilterInfo, err error) {
+	filter, exists := p4infoHelper.learnFilters[id]
+	if !exists {
+		err = fmt.Errorf("Unable to find learn filter %d", id)
+	}
+	return
+}
+
+func (table *TableInfo) GetAction(name string) (action *ActionInfo, err error) {
+	for i := range table.ActionSpecs {
+		if table.ActionSpecs[i].Name == name {
+			return &table.ActionSpecs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find action %s in table %s", name, table.Name)
+}
+
+func (table *TableInfo) GetDataField(name string) (field *FieldInfo, err error) {
+	for i := range table.Data {
+		if table.Data[i].Singleton.Name == name {
+			return &table.Data[i].Singleton, nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find data field %s in table %s", name, table.Name)
+}
+
+func (table *TableInfo) GetKey(name string) (key *KeyInfo, err error) {
+	for i := range table.Key {
+		if table.Key[i].Name == name {
+			return &table.Key[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find key field %s in table %s", name, table.Name)
+}
+
+// Bits returns the width of the type, which bfrt.json only gives for bytes fields.
+func (t TypeInfo) Bits() int {
+	switch t.Type {
+	case "bool", "uint8":
+		return 8
+	case "uint16":
+		return 16
+	case "uint32":
+		return 32
+	case "uint64":
+		return 64
+	}
+	return t.Width
+}
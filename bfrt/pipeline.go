@@ -6,48 +6,194 @@
 package bfrt
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/P4Networking/proto/go/p4"
 	"github.com/pkg/errors"
 )
 
-func getPipelineConfig(client p4.BfRuntimeClient, clientId, deviceId uint32) ([]*p4.ForwardingPipelineConfig, error) {
+func getPipelineConfig(ctx context.Context, client p4.BfRuntimeClient, clientId, deviceId uint32) ([]*p4.ForwardingPipelineConfig, error) {
 	req := &p4.GetForwardingPipelineConfigRequest{
 		ClientId: clientId,
 		DeviceId: deviceId,
 	}
-	res, err := client.GetForwardingPipelineConfig(context.Background(), req)
+	res, err := client.GetForwardingPipelineConfig(ctx, req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting pipeline config")
 	}
-	res.GetConfig()
 	return res.GetConfig(), nil
 }
 
-func setPipelineConfig(client p4.BfRuntimeClient, clientId, deviceId uint32, p4Name string) error {
+func setPipelineConfig(ctx context.Context, client p4.BfRuntimeClient, clientId, deviceId uint32, action p4.SetForwardingPipelineConfigRequest_Action, basePath string, config *p4.ForwardingPipelineConfig) (*p4.SetForwardingPipelineConfigResponse, error) {
 	req := &p4.SetForwardingPipelineConfigRequest{
 		ClientId: clientId,
 		DeviceId: deviceId,
-		Action:   p4.SetForwardingPipelineConfigRequest_BIND,
-		Config: []*p4.ForwardingPipelineConfig{
-			{
-				P4Name: p4Name,
-			},
-		},
-	}
-	_, err := client.SetForwardingPipelineConfig(context.Background(), req)
-	// ignore the response; it is an empty message
+		Action:   action,
+		BasePath: basePath,
+		Config:   []*p4.ForwardingPipelineConfig{config},
+	}
+	return client.SetForwardingPipelineConfig(ctx, req)
+}
+
+// ParsePipelineAction returns the SetForwardingPipelineConfig action with the given
+// name, e.g. "verify_and_warm_init_begin_and_end".
+func ParsePipelineAction(name string) (p4.SetForwardingPipelineConfigRequest_Action, error) {
+	action, ok := p4.SetForwardingPipelineConfigRequest_Action_value[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown pipeline action %q", name)
+	}
+	return p4.SetForwardingPipelineConfigRequest_Action(action), nil
+}
+
+// PipelinePush describes how long a pipeline push took.
+type PipelinePush struct {
+	Action p4.SetForwardingPipelineConfigRequest_Action
+	Start  time.Time
+	// Response is the time until the switch answered the request
+	Response time.Duration
+	// Done is the time until the switch reported that warm init finished, or the
+	// same as Response if the action completed with the request
+	Done  time.Duration
+	Async bool // whether the switch reported completion on the stream
+}
+
+func (c *bfrtClient) SetForwardingPipelineConfig() error {
+	return c.SetForwardingPipelineConfigContext(context.Background())
+}
+
+// SetForwardingPipelineConfigContext binds the client to the program named by its P4Name.
+func (c *bfrtClient) SetForwardingPipelineConfigContext(ctx context.Context) error {
+	c.streamLock.Lock()
+	p4Name := c.p4Name
+	c.streamLock.Unlock()
+	_, err := c.PushPipelineConfigContext(ctx, p4.SetForwardingPipelineConfigRequest_BIND, &Program{P4Name: p4Name})
 	return err
 }
 
-func (c *bfrtClient) SetForwardingPipelineConfig() (err error) {
-	err = setPipelineConfig(c.client, c.clientId, c.deviceId, c.p4Name)
+func (c *bfrtClient) PushPipelineConfig(action p4.SetForwardingPipelineConfigRequest_Action, program *Program) (PipelinePush, error) {
+	return c.PushPipelineConfigContext(context.Background(), action, program)
+}
+
+// PushPipelineConfigContext sends program to the switch with the given action. If the
+// switch answers that warm init started, it waits for the stream to report that it
+// finished, unless the action leaves warm init to a later WARM_INIT_END. Every action
+// but VERIFY leaves the client bound to the program, which it binds again after
+// reconnecting. Only one push may be in progress at a time; a push started while
+// another is in progress fails.
+func (c *bfrtClient) PushPipelineConfigContext(ctx context.Context, action p4.SetForwardingPipelineConfigRequest_Action, program *Program) (push PipelinePush, err error) {
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+
+	// Listen for completion before sending, as it may arrive before the response
+	done := make(chan struct{}, 1)
+	c.streamLock.Lock()
+	if c.pipelineDone != nil {
+		c.streamLock.Unlock()
+		return push, errors.New("a pipeline push is already in progress")
+	}
+	c.pipelineDone = done
+	c.streamLock.Unlock()
+	defer func() {
+		c.streamLock.Lock()
+		if c.pipelineDone == done {
+			c.pipelineDone = nil
+		}
+		c.streamLock.Unlock()
+	}()
+
+	push = PipelinePush{Action: action, Start: time.Now()}
+	res, err := setPipelineConfig(ctx, c.client, c.clientId, c.deviceId, action, c.pipelineBasePath, program.config())
+	push.Response = time.Since(push.Start)
+	push.Done = push.Response
 	if err != nil {
 		return
 	}
+	if res.GetSetForwardingPipelineConfigResponseType() == p4.SetForwardingPipelineConfigResponseType_WARM_INIT_STARTED &&
+		action != p4.SetForwardingPipelineConfigRequest_VERIFY_AND_WARM_INIT_BEGIN {
+		push.Async = true
+		select {
+		case <-done:
+			push.Done = time.Since(push.Start)
+		case <-ctx.Done():
+			err = errors.Wrap(ctx.Err(), "error waiting for warm init to finish")
+			return
+		}
+	}
+	if action == p4.SetForwardingPipelineConfigRequest_VERIFY {
+		return
+	}
+	c.streamLock.Lock()
+	c.p4Name = program.P4Name
+	c.pipelineBound = true
+	c.streamLock.Unlock()
 	return
 }
 
+// matches reports whether config is the program, comparing bf-rt.json unless the
+// program only has a name.
+func matches(program *Program, config *p4.ForwardingPipelineConfig) bool {
+	if config.GetP4Name() != program.P4Name {
+		return false
+	}
+	return len(program.BfruntimeInfo) == 0 || bytes.Equal(config.GetBfruntimeInfo(), program.BfruntimeInfo)
+}
+
+func (c *bfrtClient) UpdatePipelineConfig(action p4.SetForwardingPipelineConfigRequest_Action, program *Program, forcePush bool) (bool, PipelinePush, error) {
+	return c.UpdatePipelineConfigContext(context.Background(), action, program, forcePush)
+}
+
+// UpdatePipelineConfigContext pushes program with the given action, unless the switch
+// already runs it and forcePush is false, in which case the client only binds to it.
+// It reports whether the program was pushed, and how long the push or bind took.
+func (c *bfrtClient) UpdatePipelineConfigContext(ctx context.Context, action p4.SetForwardingPipelineConfigRequest_Action, program *Program, forcePush bool) (pushed bool, push PipelinePush, err error) {
+	if !forcePush {
+		configs, err := c.GetForwardingPipelineConfigContext(ctx)
+		if err != nil {
+			return false, push, err
+		}
+		for _, config := range configs {
+			if matches(program, config) {
+				push, err = c.PushPipelineConfigContext(ctx, p4.SetForwardingPipelineConfigRequest_BIND, &Program{P4Name: program.P4Name})
+				return false, push, err
+			}
+		}
+	}
+	push, err = c.PushPipelineConfigContext(ctx, action, program)
+	return true, push, err
+}
+
+func (c *bfrtClient) handlePipelineConfigResponse(res *p4.SetForwardingPipelineConfigResponse) {
+	if res.GetSetForwardingPipelineConfigResponseType() != p4.SetForwardingPipelineConfigResponseType_WARM_INIT_FINISHED {
+		return
+	}
+	c.streamLock.Lock()
+	done := c.pipelineDone
+	c.streamLock.Unlock()
+	if done == nil {
+		fmt.Println("warm init finished, but no pipeline push is in progress")
+		return
+	}
+	select {
+	case done <- struct{}{}:
+	default:
+	}
+}
+
+// SetPipelineBasePath sets the directory the switch saves pushed programs in.
+func (c *bfrtClient) SetPipelineBasePath(basePath string) {
+	c.pipelineBasePath = basePath
+}
+
 func (c *bfrtClient) GetForwardingPipelineConfig() ([]*p4.ForwardingPipelineConfig, error) {
-	return getPipelineConfig(c.client, c.clientId, c.deviceId)
+	return c.GetForwardingPipelineConfigContext(context.Background())
+}
+
+func (c *bfrtClient) GetForwardingPipelineConfigContext(ctx context.Context) ([]*p4.ForwardingPipelineConfig, error) {
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	return getPipelineConfig(ctx, c.client, c.clientId, c.deviceId)
 }
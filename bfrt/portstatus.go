@@ -0,0 +1,54 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// PortStatus reports a port going up or down.
+type PortStatus struct {
+	DevPort  uint32         // $DEV_PORT of the port
+	Up       bool           // whether the port is up
+	PortKey  *p4.TableEntry // key of the port in the $PORT table
+	Received time.Time
+}
+
+func (s PortStatus) String() string {
+	if s.Up {
+		return fmt.Sprintf("port %d up", s.DevPort)
+	}
+	return fmt.Sprintf("port %d down", s.DevPort)
+}
+
+func (c *bfrtClient) SetPortStatusChan(portStatusChan chan PortStatus) {
+	c.portStatusChan = portStatusChan
+}
+
+func (c *bfrtClient) handlePortStatus(notification *p4.PortStatusChgNotification) {
+	if c.portStatusChan == nil {
+		return
+	}
+	portStatus := PortStatus{
+		Up:       notification.GetPortUp(),
+		PortKey:  notification.GetPortKey(),
+		Received: time.Now(),
+	}
+	// The $PORT table is keyed by $DEV_PORT alone
+	if fields := notification.GetPortKey().GetKey().GetFields(); len(fields) > 0 {
+		for _, b := range fields[0].GetExact().GetValue() {
+			portStatus.DevPort = portStatus.DevPort<<8 | uint32(b)
+		}
+	}
+	select {
+	case c.portStatusChan <- portStatus: // put notification into the channel unless it is full
+	default:
+		fmt.Println("Port status channel full. Discarding notification")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// Files written by bf-p4c for a program and each of its profiles
+const (
+	bfruntimeInfoFile = "bf-rt.json"
+	contextFile       = "context.json"
+)
+
+// Device binaries, one of which is found in each profile directory
+var binaryFiles = []string{"tofino.bin", "tofino2.bin", "tofino3.bin"}
+
+// Program is a P4 program compiled by bf-p4c, as pushed to the switch.
+type Program struct {
+	P4Name        string
+	BfruntimeInfo []byte // bf-rt.json
+	Profiles      []Profile
+}
+
+// Profile is the part of a program loaded on a set of pipes.
+type Profile struct {
+	Name      string
+	Context   []byte   // context.json
+	Binary    []byte   // tofino.bin
+	PipeScope []uint32 // pipes running the profile; empty for all pipes
+}
+
+// programConf is the part of the <program>.conf file written by bf-p4c that describes
+// the profiles of the program.
+type programConf struct {
+	P4Devices []struct {
+		P4Programs []struct {
+			ProgramName string `json:"program-name"`
+			P4Pipelines []struct {
+				Name      string   `json:"p4_pipeline_name"`
+				PipeScope []uint32 `json:"pipe_scope"`
+			} `json:"p4_pipelines"`
+		} `json:"p4_programs"`
+	} `json:"p4_devices"`
+}
+
+// LoadProgram reads the program bf-p4c compiled into buildDir: bf-rt.json at its root
+// and one profile per directory holding a context.json and a device binary. The
+// program name and pipe scopes are taken from the .conf file in buildDir if there is
+// one; otherwise the program is named after buildDir and every profile runs on all
+// pipes. A non-empty p4Name overrides the program name.
+func LoadProgram(buildDir, p4Name string) (*Program, error) {
+	program := &Program{P4Name: filepath.Base(filepath.Clean(buildDir))}
+	var err error
+	program.BfruntimeInfo, err = ioutil.ReadFile(filepath.Join(buildDir, bfruntimeInfoFile))
+	if err != nil {
+		return nil, err
+	}
+
+	pipeScopes := make(map[string][]uint32)
+	confs, err := filepath.Glob(filepath.Join(buildDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(confs) > 0 {
+		confBytes, err := ioutil.ReadFile(confs[0])
+		if err != nil {
+			return nil, err
+		}
+		var conf programConf
+		if err := json.Unmarshal(confBytes, &conf); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", confs[0], err)
+		}
+		for _, device := range conf.P4Devices {
+			for _, p4Program := range device.P4Programs {
+				program.P4Name = p4Program.ProgramName
+				for _, pipeline := range p4Program.P4Pipelines {
+					pipeScopes[pipeline.Name] = pipeline.PipeScope
+				}
+			}
+		}
+	}
+	if p4Name != "" {
+		program.P4Name = p4Name
+	}
+
+	dirs, err := ioutil.ReadDir(buildDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		profile, ok, err := loadProfile(filepath.Join(buildDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		profile.PipeScope = pipeScopes[profile.Name]
+		program.Profiles = append(program.Profiles, profile)
+	}
+	if len(program.Profiles) == 0 {
+		return nil, fmt.Errorf("no profile found in %s", buildDir)
+	}
+	sort.Slice(program.Profiles, func(i, j int) bool { return program.Profiles[i].Name < program.Profiles[j].Name })
+	return program, nil
+}
+
+// loadProfile reads the profile in dir, if dir holds one.
+func loadProfile(dir string) (profile Profile, ok bool, err error) {
+	profile.Name = filepath.Base(dir)
+	profile.Context, err = ioutil.ReadFile(filepath.Join(dir, contextFile))
+	if os.IsNotExist(err) {
+		return profile, false, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, name := range binaryFiles {
+		profile.Binary, err = ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		return profile, true, nil
+	}
+	return profile, false, fmt.Errorf("no device binary found in %s", dir)
+}
+
+// Size returns the number of bytes of the program sent to the switch.
+func (p *Program) Size() int {
+	size := len(p.BfruntimeInfo)
+	for _, profile := range p.Profiles {
+		size += len(profile.Context) + len(profile.Binary)
+	}
+	return size
+}
+
+func (p *Program) config() *p4.ForwardingPipelineConfig {
+	config := &p4.ForwardingPipelineConfig{
+		P4Name:        p.P4Name,
+		BfruntimeInfo: p.BfruntimeInfo,
+	}
+	for _, profile := range p.Profiles {
+		config.Profiles = append(config.Profiles, &p4.ForwardingPipelineConfig_Profile{
+			ProfileName: profile.Name,
+			Context:     profile.Context,
+			Binary:      profile.Binary,
+			PipeScope:   profile.PipeScope,
+		})
+	}
+	return config
+}
@@ -0,0 +1,69 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/P4Networking/proto/go/p4"
+	"github.com/pkg/errors"
+)
+
+// read sends a Read request for entities and returns the entities of every response.
+func (c *bfrtClient) read(ctx context.Context, entities []*p4.Entity) ([]*p4.Entity, error) {
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	c.streamLock.Lock()
+	p4Name := c.p4Name
+	c.streamLock.Unlock()
+
+	req := &p4.ReadRequest{
+		ClientId: c.clientId,
+		Target: &p4.TargetDevice{
+			DeviceId: c.deviceId,
+			PipeId:   0xffff,
+		},
+		Entities: entities,
+		P4Name:   p4Name,
+	}
+	stream, err := c.client.Read(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading")
+	}
+	var results []*p4.Entity
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading")
+		}
+		results = append(results, res.GetEntities()...)
+	}
+}
+
+func (c *bfrtClient) ReadTableUsage(tableId uint32) (uint32, error) {
+	return c.ReadTableUsageContext(context.Background(), tableId)
+}
+
+// ReadTableUsageContext returns the number of entries in the table, across all pipes.
+func (c *bfrtClient) ReadTableUsageContext(ctx context.Context, tableId uint32) (uint32, error) {
+	entities, err := c.read(ctx, []*p4.Entity{{
+		Entity: &p4.Entity_TableUsage{TableUsage: &p4.TableUsage{TableId: tableId}},
+	}})
+	if err != nil {
+		return 0, err
+	}
+	for _, entity := range entities {
+		if usage := entity.GetTableUsage(); usage != nil && usage.GetTableId() == tableId {
+			return usage.GetUsage(), nil
+		}
+	}
+	return 0, fmt.Errorf("no usage returned for table %d", tableId)
+}
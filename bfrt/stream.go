@@ -0,0 +1,184 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/P4Networking/proto/go/p4"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMinReconnectBackoff = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 10 * time.Second
+)
+
+// SetReconnectBackoff sets the delays between attempts to re-open a failed stream,
+// doubling from min up to max. A max of zero disables reconnection.
+func (c *bfrtClient) SetReconnectBackoff(min, max time.Duration) {
+	c.minReconnectBackoff = min
+	c.maxReconnectBackoff = max
+}
+
+// openStream opens a new stream, replacing the current one.
+func (c *bfrtClient) openStream() error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	stream, err := c.client.StreamChannel(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	c.streamLock.Lock()
+	if c.streamCancel != nil {
+		c.streamCancel()
+	}
+	c.stream, c.streamCancel = stream, cancel
+	c.streamLock.Unlock()
+	return nil
+}
+
+// send sends req on the current stream.
+func (c *bfrtClient) send(req *p4.StreamMessageRequest) error {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	return c.stream.Send(req)
+}
+
+func (c *bfrtClient) receiveStream() {
+	defer close(c.receiverDone)
+	for {
+		c.streamLock.Lock()
+		stream := c.stream
+		c.streamLock.Unlock()
+
+		res, err := stream.Recv()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return // the client was closed
+			}
+			fmt.Printf("stream recv error: %v\n", err)
+			c.sendEvent(StreamDisconnected, err)
+			if c.setMaster(false) {
+				c.sendEvent(MastershipLost, err)
+			}
+			if !c.reconnect() {
+				return
+			}
+			continue
+		}
+		c.dispatcher.dispatch(res)
+	}
+}
+
+// registerHandlers routes each kind of message received on the stream to its handler.
+func (c *bfrtClient) registerHandlers() {
+	c.dispatcher = newDispatcher()
+	// Mastership changes are handled in order with stream failures
+	c.dispatcher.handle(SubscribeMessage, 0, func(res *p4.StreamMessageResponse) {
+		c.handleSubscribe(res.GetSubscribe())
+	})
+	c.dispatcher.handle(DigestMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handleDigest(res.GetDigest())
+	})
+	c.dispatcher.handle(IdleTimeoutMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handleIdleTimeout(res.GetIdleTimeoutNotification())
+	})
+	c.dispatcher.handle(PortStatusMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handlePortStatus(res.GetPortStatusChangeNotification())
+	})
+	c.dispatcher.handle(PipelineConfigMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handlePipelineConfigResponse(res.GetSetForwardingPipelineConfigResponse())
+	})
+	c.dispatcher.handle(ErrorMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handleStreamError(res.GetError())
+	})
+}
+
+// StreamStats returns how many messages of each handled kind were received on the
+// stream, and how many were dropped because their handler fell behind.
+func (c *bfrtClient) StreamStats() []StreamStats {
+	return c.dispatcher.stats()
+}
+
+func (c *bfrtClient) handleSubscribe(sub *p4.Subscribe) {
+	if code.Code(sub.GetStatus().GetCode()) != code.Code_OK {
+		fmt.Printf("client is not master: %s\n", sub.GetStatus().GetMessage())
+		if c.setMaster(false) {
+			c.sendEvent(MastershipLost, status.ErrorProto(sub.GetStatus()))
+		}
+		return
+	}
+	fmt.Println("client is master")
+	if c.setMaster(true) {
+		c.sendEvent(MastershipAcquired, nil)
+	}
+	c.streamLock.Lock()
+	restore := c.restorePipeline
+	c.restorePipeline = false
+	c.streamLock.Unlock()
+	if restore {
+		go c.rebindPipeline()
+	}
+}
+
+// reconnect re-opens the stream, backing off between attempts, and subscribes again
+// if the client had subscribed before. It returns false if the client is closed or
+// reconnection is disabled.
+func (c *bfrtClient) reconnect() bool {
+	backoff := c.minReconnectBackoff
+	if backoff <= 0 {
+		backoff = defaultMinReconnectBackoff
+	}
+	for {
+		if c.maxReconnectBackoff <= 0 {
+			return false
+		}
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		err := c.openStream()
+		if err == nil {
+			break
+		}
+		fmt.Printf("stream reconnect error: %v\n", err)
+		backoff *= 2
+		if backoff > c.maxReconnectBackoff {
+			backoff = c.maxReconnectBackoff
+		}
+	}
+	c.sendEvent(StreamConnected, nil)
+
+	c.streamLock.Lock()
+	mastershipReq := c.mastershipReq
+	// The pipeline is bound again once the switch answers the subscription
+	c.restorePipeline = mastershipReq != nil && c.pipelineBound
+	c.streamLock.Unlock()
+	if mastershipReq != nil {
+		if err := c.send(mastershipReq); err != nil {
+			fmt.Printf("stream resubscribe error: %v\n", err)
+		}
+	}
+	return true
+}
+
+func (c *bfrtClient) rebindPipeline() {
+	ctx, cancel := withTimeout(c.ctx, c.rpcTimeout)
+	defer cancel()
+	c.streamLock.Lock()
+	p4Name := c.p4Name
+	c.streamLock.Unlock()
+	_, err := setPipelineConfig(ctx, c.client, c.clientId, c.deviceId, p4.SetForwardingPipelineConfigRequest_BIND, "", &p4.ForwardingPipelineConfig{P4Name: p4Name})
+	if err != nil {
+		fmt.Printf("pipeline rebind error: %v\n", err)
+	}
+	c.sendEvent(PipelineRestored, err)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package bfrt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/P4Networking/proto/go/p4"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+)
+
+// StreamError is a failure the switch reported asynchronously on the stream, e.g.
+// for a digest ack it could not process.
+type StreamError struct {
+	Code       codes.Code
+	Message    string
+	Space      string // space of TargetCode, e.g. the target's error codes
+	TargetCode int32
+	// Request is the stream request that failed, if the switch sent it back in the
+	// error details
+	Request  *p4.StreamMessageRequest
+	Received time.Time
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("%s request failed: %s: %s", e.RequestKind(), e.Code, e.Message)
+}
+
+// RequestKind names the kind of the failed request: subscribe, digest_ack or
+// unknown if the request is not known.
+func (e StreamError) RequestKind() string {
+	switch e.Request.GetUpdate().(type) {
+	case *p4.StreamMessageRequest_Subscribe:
+		return "subscribe"
+	case *p4.StreamMessageRequest_DigestAck:
+		return "digest_ack"
+	default:
+		return "unknown"
+	}
+}
+
+// SetStreamErrorChan delivers the errors reported on the stream to errorChan.
+func (c *bfrtClient) SetStreamErrorChan(errorChan chan StreamError) {
+	c.streamErrorChan = errorChan
+}
+
+func (c *bfrtClient) handleStreamError(p4Err *p4.Error) {
+	streamErr := StreamError{
+		Code:       codes.Code(p4Err.GetCanonicalCode()),
+		Message:    p4Err.GetMessage(),
+		Space:      p4Err.GetSpace(),
+		TargetCode: p4Err.GetCode(),
+		Received:   time.Now(),
+	}
+	if details := p4Err.GetDetails(); details != nil {
+		req := &p4.StreamMessageRequest{}
+		if ptypes.UnmarshalAny(details, req) == nil {
+			streamErr.Request = req
+		}
+	}
+	fmt.Printf("stream error: %v\n", streamErr)
+
+	if c.streamErrorChan == nil {
+		return
+	}
+	select {
+	case c.streamErrorChan <- streamErr: // put error into the channel unless it is full
+	default:
+		fmt.Println("Stream error channel full. Discarding error")
+	}
+}
@@ -17,23 +17,46 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+var errNotMaster = status.Error(codes.PermissionDenied, "client is not master")
+
 type p4Write struct {
+	ctx  context.Context
 	req  *p4.WriteRequest
 	resp chan []*p4.Error
 }
 
 type WriteTrace struct {
 	BatchSize int
+	Start     time.Time
 	Duration  time.Duration
+	Code      codes.Code // gRPC status of the Write RPC, e.g. DeadlineExceeded on timeout
 	Errors    []*p4.Error
 }
 
 func (c *bfrtClient) Write(req *p4.WriteRequest) <-chan []*p4.Error {
+	return c.WriteContext(context.Background(), req)
+}
+
+// WriteContext queues req for writing. If ctx is done before the write is sent,
+// the write fails with the context's error; after Close, it fails with CANCELLED.
+func (c *bfrtClient) WriteContext(ctx context.Context, req *p4.WriteRequest) <-chan []*p4.Error {
 	res := make(chan []*p4.Error, c.batchSize)
-	c.writes <- p4Write{
+	write := p4Write{
+		ctx:  ctx,
 		req:  proto.Clone(req).(*p4.WriteRequest),
 		resp: res,
 	}
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+	if c.closed {
+		go processWriteResponse(write, status.Error(codes.Canceled, "client is closed"), c.batchSize, time.Now(), c.writeTraceChan)
+		return res
+	}
+	select {
+	case c.writes <- write:
+	case <-ctx.Done():
+		go processWriteResponse(write, status.FromContextError(ctx.Err()).Err(), c.batchSize, time.Now(), c.writeTraceChan)
+	}
 	return res
 }
 
@@ -42,11 +65,18 @@ func (c *bfrtClient) SetWriteTraceChan(traceChan chan WriteTrace) {
 }
 
 func (c *bfrtClient) ListenForWrites() {
-	for {
-		write := <-c.writes // wait for the first write in the batch
+	defer c.writers.Done()
+	for write := range c.writes { // wait for the first write in the batch; stop once closed and drained
+		if !c.IsMaster() {
+			// The switch would reject the write; fail it without sending it
+			go processWriteResponse(write, errNotMaster, c.batchSize, time.Now(), c.writeTraceChan)
+			continue
+		}
 		// Write the request
+		ctx, cancel := withTimeout(write.ctx, c.writeTimeout)
 		start := time.Now()
-		_, err := c.client.Write(context.Background(), write.req)
+		_, err := c.client.Write(ctx, write.req)
+		cancel()
 		// ignore the write response; it is an empty message (details, if any, are in err)
 		go processWriteResponse(write, err, c.batchSize, start, c.writeTraceChan)
 	}
@@ -61,7 +91,9 @@ func processWriteResponse(write p4Write, err error, batchSize int, start time.Ti
 	if traceChan != nil {
 		trace := WriteTrace{
 			BatchSize: batchSize,
+			Start:     start,
 			Duration:  duration,
+			Code:      status.Code(err),
 			Errors:    errors,
 		}
 		select {
@@ -95,6 +127,7 @@ func parseBFRuntimeWriteError(err error, batchSize int) []*p4.Error {
 			}
 			return errors
 		}
+		code = grpcError.GetCode()
 		message = grpcError.GetMessage()
 	} else {
 		code = int32(codes.OK)
@@ -0,0 +1,150 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/proto/go/p4"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+)
+
+// runAgingBenchmark inserts entries with a -ttl idle timeout and measures how long
+// after its insertion the switch reports each entry as aged out.
+func runAgingBenchmark() {
+	if ttl <= 0 {
+		panic(fmt.Errorf("the aging test needs a -ttl"))
+	}
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+	defer client.Close()
+	bindPipeline(client)
+
+	// Notifications are enabled on the table the entries are written to
+	name := workloadTable
+	if name == "" {
+		name = tableName
+	}
+	tableID, err := p4infoHelper.GetP4Id(name)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := rpcContext()
+	err = client.EnableIdleTimeoutNotifications(ctx, tableID, ttlQueryInterval, ttl, ttl)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+
+	numEntries := iterations * batchSize
+	idleTimeoutChan := make(chan bfrt.IdleTimeout, numEntries)
+	client.SetIdleTimeoutChan(idleTimeoutChan)
+
+	// Remember when each entry was inserted, by key
+	var lock sync.Mutex
+	inserted := make(map[string]time.Time, numEntries)
+	var failed int
+	var inserts sync.WaitGroup
+	for _, req := range BuildTableEntries(client, iterations, batchSize) {
+		req := req
+		res := client.Write(req)
+		inserts.Add(1)
+		go func() {
+			defer inserts.Done()
+			errors := <-res
+			now := time.Now()
+			lock.Lock()
+			defer lock.Unlock()
+			for i, update := range req.Updates {
+				if errors[i].GetCanonicalCode() != int32(codes.OK) {
+					failed++
+					continue
+				}
+				inserted[entryKey(update.GetEntity().GetTableEntry())] = now
+			}
+		}()
+	}
+	inserts.Wait()
+	fmt.Printf("Inserted %d entries (%d failed), waiting for them to age out\n", len(inserted), failed)
+
+	// Wait for every entry to be reported, giving the switch -duration past the TTL
+	var ages []time.Duration
+	var first, last time.Time
+	var unknown int
+	deadline := time.After(ttl + duration)
+	for waiting := true; waiting && len(inserted) > 0; {
+		select {
+		case idleTimeout := <-idleTimeoutChan:
+			key := entryKey(idleTimeout.Entry)
+			insertedAt, ok := inserted[key]
+			if !ok {
+				unknown++
+				continue
+			}
+			delete(inserted, key)
+			if len(ages) == 0 {
+				first = idleTimeout.Received
+			}
+			last = idleTimeout.Received
+			ages = append(ages, idleTimeout.Received.Sub(insertedAt))
+		case <-deadline:
+			waiting = false
+		}
+	}
+
+	errors := make([]time.Duration, len(ages))
+	for i, age := range ages {
+		errors[i] = age - ttl
+	}
+	fmt.Printf("Aged out entries reported: %d, not reported: %d, unknown: %d\n", len(ages), len(inserted), unknown)
+	fmt.Printf("Time from insertion to notification: %v\n", summarize(ages))
+	fmt.Printf("Notification delay past the TTL: %v\n", summarize(errors))
+	logStreamStats(client.StreamStats())
+	fmt.Printf("Number of stream errors: %v\n", &streamErrors)
+	if len(ages) > 1 {
+		fmt.Printf("Notification rate: %.1f entries/sec\n", float64(len(ages)-1)/last.Sub(first).Seconds())
+	}
+
+	fileName := fmt.Sprintf("aging-result-%d-%d-%d.csv", numEntries, ttl.Milliseconds(), time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	resultWriter := csv.NewWriter(csvFile)
+	resultWriter.Write([]string{"Index of notifications", "µs from insertion to notification"})
+	for i, d := range ages {
+		resultWriter.Write([]string{strconv.Itoa(i), strconv.FormatInt(d.Microseconds(), 10)})
+	}
+	resultWriter.Flush()
+}
+
+// entryKey identifies a table entry by its serialized key, whatever the match types
+// of its fields. The fields are sorted by ID, in case the switch reorders them.
+func entryKey(entry *p4.TableEntry) string {
+	key := &p4.TableKey{Fields: append([]*p4.KeyField(nil), entry.GetKey().GetFields()...)}
+	sort.Slice(key.Fields, func(i, j int) bool { return key.Fields[i].GetFieldId() < key.Fields[j].GetFieldId() })
+	b, err := proto.Marshal(key)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,180 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/proto/go/p4"
+	"google.golang.org/grpc/codes"
+)
+
+// Number of occupancy ranges the latency curve of the capacity test is split into
+const capacityBuckets = 10
+
+// capacitySample is the latency of one batch inserted into a table holding
+// occupancy entries.
+type capacitySample struct {
+	occupancy uint64
+	inserted  int
+	latency   time.Duration
+	err       string
+}
+
+// runCapacityBenchmark inserts batches of -batchSize entries into -table until the
+// switch reports RESOURCE_EXHAUSTED, measuring the write latency as the table fills
+// up. The entries are deleted at the end.
+func runCapacityBenchmark() {
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: 1,
+	})
+	defer client.Close()
+	bindPipeline(client)
+
+	name := workloadTable
+	if name == "" {
+		name = tableName
+	}
+	builder, err := newTableEntryBuilder(name, workloadAction)
+	if err != nil {
+		panic(err)
+	}
+	table := builder.table
+	fmt.Printf("Table %s (%s): %d entries in bfrt.json\n", table.Name, table.TableType, table.Size)
+	// Stop well past the declared size if the switch never runs out of space
+	limit := capacityLimit
+	if limit == 0 {
+		limit = uint64(table.Size) * 2
+	}
+	if limit == 0 {
+		panic(fmt.Errorf("bfrt.json gives no size for table %s; set -capacityLimit", table.Name))
+	}
+	ctx, cancel := rpcContext()
+	usage, err := client.ReadTableUsageContext(ctx, table.ID)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Entries in the table before the test: %d\n", usage)
+
+	var samples []capacitySample
+	var occupancy, next uint64 // entries inserted, and entries written so far
+	var exhausted bool
+	var lastErr string
+	for !exhausted && lastErr == "" && occupancy < limit {
+		req, err := builder.build(client, p4.Update_INSERT, next, batchSize)
+		if err != nil {
+			fmt.Printf("\n%v\n", err)
+			break
+		}
+		start := time.Now()
+		p4Errs := <-client.Write(req)
+		sample := capacitySample{occupancy: occupancy, latency: time.Since(start)}
+		for _, p4Err := range p4Errs {
+			switch code := codes.Code(p4Err.GetCanonicalCode()); code {
+			case codes.OK:
+				sample.inserted++
+			case codes.ResourceExhausted:
+				exhausted = true
+			default:
+				lastErr = fmt.Sprintf("%v: %s", code, p4Err.GetMessage())
+			}
+		}
+		if exhausted && lastErr == "" {
+			sample.err = codes.ResourceExhausted.String()
+		} else {
+			sample.err = lastErr
+		}
+		samples = append(samples, sample)
+		occupancy += uint64(sample.inserted)
+		next += uint64(batchSize)
+		fmt.Printf("\033[2K\rInserted %d entries...", occupancy)
+	}
+	fmt.Printf("\033[2K\r")
+
+	switch {
+	case exhausted:
+		fmt.Printf("Table full after %d entries (%.1f%% of bfrt.json size)\n", occupancy, percentOf(occupancy, table.Size))
+	case lastErr != "":
+		fmt.Printf("Stopped after %d entries: %s\n", occupancy, lastErr)
+	default:
+		fmt.Printf("Stopped after %d entries without RESOURCE_EXHAUSTED\n", occupancy)
+	}
+	ctx, cancel = rpcContext()
+	usage, err = client.ReadTableUsageContext(ctx, table.ID)
+	cancel()
+	if err != nil {
+		fmt.Printf("error reading table usage: %v\n", err)
+	} else {
+		fmt.Printf("Entries in the table reported by the switch: %d\n", usage)
+	}
+	printCapacityCurve(samples, occupancy)
+
+	// Empty the table for the next run. Entries that did not fit were never inserted.
+	for first := uint64(0); first < next; first += uint64(batchSize) {
+		req, err := builder.build(client, p4.Update_DELETE, first, batchSize)
+		if err != nil {
+			panic(err)
+		}
+		for _, p4Err := range <-client.Write(req) {
+			if code := codes.Code(p4Err.GetCanonicalCode()); code != codes.OK && code != codes.NotFound {
+				fmt.Printf("error deleting entries: %v: %s\n", code, p4Err.GetMessage())
+			}
+		}
+	}
+
+	fileName := fmt.Sprintf("capacity-result-%s-%d-%d.csv", lastComponent(table.Name), batchSize, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	defer writer.Flush()
+	writer.Write([]string{"Occupancy", "Inserted", "µs/write request", "Error"})
+	for _, s := range samples {
+		writer.Write([]string{strconv.FormatUint(s.occupancy, 10), strconv.Itoa(s.inserted),
+			strconv.FormatInt(s.latency.Microseconds(), 10), s.err})
+	}
+}
+
+// printCapacityCurve summarizes the write latency over equal ranges of occupancy,
+// from empty to capacity entries.
+func printCapacityCurve(samples []capacitySample, capacity uint64) {
+	if capacity == 0 {
+		return
+	}
+	buckets := make([][]time.Duration, capacityBuckets)
+	for _, s := range samples {
+		i := int(s.occupancy * capacityBuckets / capacity)
+		if i >= capacityBuckets {
+			i = capacityBuckets - 1
+		}
+		buckets[i] = append(buckets[i], s.latency)
+	}
+	fmt.Printf("Write latency by occupancy:\n")
+	for i, latencies := range buckets {
+		fmt.Printf("  %3d%%-%3d%%: %v\n", i*100/capacityBuckets, (i+1)*100/capacityBuckets, summarize(latencies))
+	}
+}
+
+func percentOf(n uint64, size int64) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(size)
+}
@@ -0,0 +1,198 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/pisc/util"
+	f "github.com/P4Networking/pisc/util/enums"
+	"github.com/P4Networking/proto/go/p4"
+	"google.golang.org/grpc/codes"
+)
+
+// learnedEntryBuilder turns learned entries into inserts into a table, matching
+// each key field with the learned field of the same name.
+type learnedEntryBuilder struct {
+	table    *bfrt.TableInfo
+	actionID uint32
+}
+
+func newLearnedEntryBuilder(tableName, actionName string) (*learnedEntryBuilder, error) {
+	table, err := p4infoHelper.GetTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	action, err := table.GetAction(actionName)
+	if err != nil {
+		return nil, err
+	}
+	return &learnedEntryBuilder{table: table, actionID: action.ID}, nil
+}
+
+// lastComponent strips the header or control prefix from a field name.
+func lastComponent(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (b *learnedEntryBuilder) build(client bfrt.BFRuntimeClient, digest bfrt.Digest) (*p4.WriteRequest, error) {
+	updates := make([]*p4.Update, len(digest.Entries))
+	for i, entry := range digest.Entries {
+		fields := make([]*p4.KeyField, len(b.table.Key))
+		for j, key := range b.table.Key {
+			value, ok := entry[key.Name]
+			if !ok {
+				for name, v := range entry {
+					if lastComponent(name) == lastComponent(key.Name) {
+						value, ok = v, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("digest %s has no field for key %s of table %s", digest.Filter, key.Name, b.table.Name)
+			}
+			fields[j] = util.GenKeyField(f.MATCH_EXACT, key.ID, value)
+		}
+		updates[i] = &p4.Update{
+			Type: p4.Update_INSERT,
+			Entity: &p4.Entity{Entity: &p4.Entity_TableEntry{
+				TableEntry: &p4.TableEntry{
+					TableId: b.table.ID,
+					Key:     &p4.TableKey{Fields: fields},
+					Data:    &p4.TableData{ActionId: b.actionID},
+				},
+			}},
+		}
+	}
+	return &p4.WriteRequest{
+		ClientId: client.ClientId(),
+		Target: &p4.TargetDevice{
+			DeviceId: client.DeviceID(),
+			PipeId:   0xffff,
+		},
+		Updates: updates,
+	}, nil
+}
+
+// runDigestBenchmark listens for digests for -duration and measures their arrival
+// rate. With -learnTable, it also programs every learned entry back into the switch
+// and measures the time from receiving a digest to its entries being inserted.
+func runDigestBenchmark() {
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+	defer client.Close()
+	bindPipeline(client)
+
+	var builder *learnedEntryBuilder
+	if learnTable != "" {
+		var err error
+		builder, err = newLearnedEntryBuilder(learnTable, learnAction)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	digestChan := make(chan bfrt.Digest, 1000)
+	client.SubscribeDigests(&p4infoHelper, digestChan)
+
+	var lock sync.Mutex
+	var latencies []time.Duration
+	var failed int
+	var inserts sync.WaitGroup
+
+	var digests, entries, lastCount int
+	var firstSeen, lastSeen time.Time
+	printStats := func() {
+		fmt.Printf("\033[2K\rReceived %d digests, %d entries (~%d digests/sec)...", digests, entries, digests-lastCount)
+		lastCount = digests
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+
+	fmt.Printf("Listening for digests for %v\n", duration)
+	listening := true
+	for listening {
+		select {
+		case digest := <-digestChan:
+			if digests == 0 {
+				firstSeen = digest.Received
+			}
+			lastSeen = digest.Received
+			digests++
+			entries += len(digest.Entries)
+			if builder == nil {
+				continue
+			}
+			req, err := builder.build(client, digest)
+			if err != nil {
+				panic(err)
+			}
+			res := client.Write(req)
+			inserts.Add(1)
+			go func(received time.Time) {
+				defer inserts.Done()
+				code := firstBFRuntimeFailure(<-res)
+				latency := time.Since(received)
+				lock.Lock()
+				defer lock.Unlock()
+				if code != codes.OK {
+					failed++
+					return
+				}
+				latencies = append(latencies, latency)
+			}(digest.Received)
+		case <-ticker.C:
+			printStats()
+		case <-deadline:
+			listening = false
+		}
+	}
+	inserts.Wait()
+	printStats()
+	fmt.Println()
+
+	if digests > 1 {
+		elapsed := lastSeen.Sub(firstSeen).Seconds()
+		fmt.Printf("Digest rate: %.1f digests/sec, %.1f entries/sec\n",
+			float64(digests-1)/elapsed, float64(entries)/elapsed)
+	}
+	logStreamStats(client.StreamStats())
+	fmt.Printf("Number of stream errors: %v\n", &streamErrors)
+	if builder == nil {
+		return
+	}
+	fmt.Printf("Learn-to-insert latency: %v\n", summarize(latencies))
+	fmt.Printf("Number of failed inserts: %d\n", failed)
+
+	fileName := fmt.Sprintf("digest-result-%d-%d.csv", digests, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	resultWriter := csv.NewWriter(csvFile)
+	resultWriter.Write([]string{"Index of digests", "µs from digest to insert"})
+	for i, d := range latencies {
+		resultWriter.Write([]string{strconv.Itoa(i), strconv.FormatInt(d.Microseconds(), 10)})
+	}
+	resultWriter.Flush()
+}
@@ -0,0 +1,102 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/bfrt-perf/p4rt"
+)
+
+// runDump prints what the pipeline installed on the switch is made of: its name and
+// the size and hash of each component. With -dumpFile, the device config stored in
+// that file is decoded instead.
+func runDump() {
+	switch {
+	case dumpFile != "":
+		deviceConfig, err := ioutil.ReadFile(dumpFile)
+		if err != nil {
+			panic(err)
+		}
+		printDeviceConfig(dumpFile, deviceConfig)
+	case api == "p4rt":
+		client := connectP4Runtime(p4rt.ClientOptions{
+			Host:       target,
+			DeviceID:   uint64(deviceId),
+			RoleID:     roleId,
+			BatchSize:  batchSize,
+			NumThreads: numThreads,
+		}, 1)
+		defer client.Close()
+		ctx, cancel := rpcContext()
+		config, err := client.GetDeviceConfigContext(ctx)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Cookie: %#x\n", config.GetCookie().GetCookie())
+		printDeviceConfig(target, config.GetP4DeviceConfig())
+	case api == "bfrt":
+		client := connectBFRuntime(bfrt.ClientOptions{
+			Host:       target,
+			DeviceId:   deviceId,
+			ClientId:   clientId,
+			P4Name:     p4Name,
+			BatchSize:  batchSize,
+			NumThreads: numThreads,
+		})
+		defer client.Close()
+		configs, err := client.GetForwardingPipelineConfig()
+		if err != nil {
+			panic(err)
+		}
+		for _, config := range configs {
+			unpacked := &p4rt.UnpackedDeviceConfig{
+				PipelineName: config.GetP4Name(),
+				Components: []p4rt.DeviceConfigComponent{
+					{Name: "bf-rt.json", Data: config.GetBfruntimeInfo()},
+				},
+			}
+			for _, profile := range config.GetProfiles() {
+				name := profile.GetProfileName()
+				if len(profile.GetPipeScope()) > 0 {
+					name = fmt.Sprintf("%s (pipes %v)", name, profile.GetPipeScope())
+				}
+				unpacked.Components = append(unpacked.Components,
+					p4rt.DeviceConfigComponent{Name: name + "/context.json", Data: profile.GetContext()},
+					p4rt.DeviceConfigComponent{Name: name + "/binary", Data: profile.GetBinary()},
+				)
+			}
+			printComponents(unpacked)
+		}
+	default:
+		panic(fmt.Errorf("unknown API %q", api))
+	}
+}
+
+// printDeviceConfig unpacks deviceConfig as -deviceTarget and prints its components.
+func printDeviceConfig(source string, deviceConfig []byte) {
+	fmt.Printf("Device config from %s: %d bytes, %s\n", source, len(deviceConfig), deviceTarget)
+	unpacked, err := p4rt.UnpackDeviceConfig(deviceTarget, deviceConfig)
+	if err != nil {
+		panic(err)
+	}
+	printComponents(unpacked)
+}
+
+func printComponents(unpacked *p4rt.UnpackedDeviceConfig) {
+	name := unpacked.PipelineName
+	if name == "" {
+		name = "(unnamed)"
+	}
+	fmt.Printf("Pipeline %s\n", name)
+	for _, component := range unpacked.Components {
+		fmt.Printf("  %-40s %10d bytes  sha256 %x\n", component.Name, len(component.Data), sha256.Sum256(component.Data))
+	}
+}
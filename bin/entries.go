@@ -0,0 +1,176 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/pisc/util"
+	f "github.com/P4Networking/pisc/util/enums"
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// Key field holding the priority of ternary, range and optional entries
+const matchPriority = "$MATCH_PRIORITY"
+
+// tableEntryBuilder builds distinct entries for any table described in bfrt.json,
+// with the keys generated by a keyWorkload.
+type tableEntryBuilder struct {
+	table    *bfrt.TableInfo
+	action   *bfrt.ActionInfo
+	workload *keyWorkload
+	fieldIDs []uint32 // ID of each field of the workload
+	priority *bfrt.KeyInfo
+	ttlField *bfrt.FieldInfo
+}
+
+func newTableEntryBuilder(tableName, actionName string) (*tableEntryBuilder, error) {
+	table, err := p4infoHelper.GetTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	b := &tableEntryBuilder{table: table}
+	// Without an action, the data of the entries is left to the caller, e.g. for
+	// tables implemented by an action profile
+	if actionName != "" {
+		b.action, err = table.GetAction(actionName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var fields []matchField
+	for i, key := range table.Key {
+		if key.Name == matchPriority {
+			b.priority = &table.Key[i]
+			continue
+		}
+		fields = append(fields, matchField{name: key.Name, matchType: strings.ToLower(key.MatchType), width: key.Type.Bits()})
+		b.fieldIDs = append(b.fieldIDs, key.ID)
+	}
+	b.workload, err = newKeyWorkload(fields, b.priority != nil)
+	if err != nil {
+		return nil, err
+	}
+	// Entries age out after -ttl, if set
+	if ttl > 0 {
+		b.ttlField, err = table.GetDataField("$ENTRY_TTL")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// build returns a request with count updates of entries first to first+count-1.
+func (b *tableEntryBuilder) build(client bfrt.BFRuntimeClient, updateType p4.Update_Type, first uint64, count int) (*p4.WriteRequest, error) {
+	updates := make([]*p4.Update, count)
+	for i := range updates {
+		key, err := b.key(first + uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		entry := &p4.TableEntry{
+			TableId: b.table.ID,
+			Key:     key,
+		}
+		if updateType != p4.Update_DELETE && b.action != nil {
+			entry.Data = b.data(first + uint64(i))
+		}
+		updates[i] = &p4.Update{
+			Type:   updateType,
+			Entity: &p4.Entity{Entity: &p4.Entity_TableEntry{TableEntry: entry}},
+		}
+	}
+	return &p4.WriteRequest{
+		ClientId: client.ClientId(),
+		Target: &p4.TargetDevice{
+			DeviceId: client.DeviceID(),
+			PipeId:   0xffff,
+		},
+		Updates: updates,
+	}, nil
+}
+
+// buildAll prepares iterations requests of batchSize inserts, like BuildTableEntries.
+func (b *tableEntryBuilder) buildAll(client bfrt.BFRuntimeClient, iterations, batchSize int) ([]*p4.WriteRequest, error) {
+	requests := make([]*p4.WriteRequest, iterations)
+	for i := range requests {
+		req, err := b.build(client, p4.Update_INSERT, uint64(i*batchSize), batchSize)
+		if err != nil {
+			return nil, err
+		}
+		requests[i] = req
+	}
+	b.workload.logRange(b.table.Name, uint64(iterations*batchSize))
+	return requests, nil
+}
+
+func (b *tableEntryBuilder) key(n uint64) (*p4.TableKey, error) {
+	matches, priority, err := b.workload.entry(n)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %v", b.table.Name, err)
+	}
+	fields := make([]*p4.KeyField, 0, len(matches)+1)
+	for i, m := range matches {
+		id := b.fieldIDs[i]
+		switch b.workload.fields[i].matchType {
+		case matchExact:
+			fields = append(fields, util.GenKeyField(f.MATCH_EXACT, id, m.value))
+		case matchTernary:
+			fields = append(fields, &p4.KeyField{FieldId: id, MatchType: &p4.KeyField_Ternary_{
+				Ternary: &p4.KeyField_Ternary{Value: m.value, Mask: m.mask},
+			}})
+		case matchLPM:
+			fields = append(fields, &p4.KeyField{FieldId: id, MatchType: &p4.KeyField_Lpm{
+				Lpm: &p4.KeyField_LPM{Value: m.value, PrefixLen: int32(m.prefixLen)},
+			}})
+		case matchRange:
+			fields = append(fields, &p4.KeyField{FieldId: id, MatchType: &p4.KeyField_Range_{
+				Range: &p4.KeyField_Range{Low: m.value, High: m.high},
+			}})
+		case matchOptional:
+			fields = append(fields, &p4.KeyField{FieldId: id, MatchType: &p4.KeyField_Optional_{
+				Optional: &p4.KeyField_Optional{Value: m.value, IsValid: true},
+			}})
+		default:
+			return nil, fmt.Errorf("unsupported match type %s of key %s in table %s", b.workload.fields[i].matchType, b.workload.fields[i].name, b.table.Name)
+		}
+	}
+	if b.priority != nil {
+		fields = append(fields, util.GenKeyField(f.MATCH_EXACT, b.priority.ID, fieldBytes(uint64(priority), b.priority.Type.Bits())))
+	}
+	return &p4.TableKey{Fields: fields}, nil
+}
+
+// data sets every parameter of the action to zero, and the TTL to -ttl if set. With
+// -routes, the -nextHopParam parameter is set to the next hop of entry n.
+func (b *tableEntryBuilder) data(n uint64) *p4.TableData {
+	rt, routed := b.workload.route(n)
+	fields := make([]*p4.DataField, 0, len(b.action.Data)+1)
+	for i, param := range b.action.Data {
+		value := fieldBytes(0, param.Type.Bits())
+		if routed && isNextHopParam(i, param.Name) {
+			value = nextHopValue(rt, param.Type.Bits())
+		}
+		fields = append(fields, util.GenDataField(param.ID, value))
+	}
+	if b.ttlField != nil {
+		fields = append(fields, util.GenDataField(b.ttlField.ID, fieldBytes(uint64(ttl.Milliseconds()), b.ttlField.Type.Bits())))
+	}
+	return &p4.TableData{ActionId: b.action.ID, Fields: fields}
+}
+
+// fieldBytes encodes v in network byte order in the bytes of a width-bit field.
+func fieldBytes(v uint64, width int) []byte {
+	value := make([]byte, (width+7)/8)
+	for i := len(value) - 1; i >= 0 && v != 0; i-- {
+		value[i] = byte(v)
+		v >>= 8
+	}
+	return value
+}
@@ -0,0 +1,275 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/bfrt-perf/p4rt"
+	"github.com/P4Networking/proto/go/p4"
+	p4v1 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// controller is a BfRuntime or P4Runtime client taking part in the failover test.
+type controller struct {
+	name              string
+	alwaysMaster      bool // every client of the API subscribes as master, e.g. BfRuntime
+	isMaster          func() bool
+	waitForMastership func(ctx context.Context) error
+	// write sends the i-th write request and returns the code of its first failure, if any
+	write func(i int) codes.Code
+	// takeOver prepares the controller for writing once it is master; may be nil
+	takeOver func() error
+	// fail closes or demotes the controller
+	fail  func() error
+	close func() error
+}
+
+// runFailover writes through the primary controller, takes the primary away
+// mid-run and measures how long the first backup takes to resume writing.
+func runFailover() {
+	if controllers < 2 {
+		panic(fmt.Errorf("failover test needs at least 2 controllers, got %d", controllers))
+	}
+	var ctrls []controller
+	switch api {
+	case "bfrt":
+		ctrls = bfrtControllers()
+	case "p4rt":
+		ctrls = p4rtControllers()
+	default:
+		panic(fmt.Errorf("unknown API %q", api))
+	}
+	defer func() {
+		for _, ctrl := range ctrls {
+			ctrl.close()
+		}
+	}()
+
+	at := failoverAt
+	if at < 0 {
+		at = iterations / 2
+	}
+	if at >= iterations {
+		panic(fmt.Errorf("failover at write %d, but only %d writes are sent", at, iterations))
+	}
+	primary, backup := ctrls[0], ctrls[1]
+
+	var failed int
+	for i := 0; i < at; i++ {
+		if primary.write(i) != codes.OK {
+			failed++
+		}
+	}
+
+	ctx, cancel := rpcContext()
+	defer cancel()
+	masterChan := make(chan time.Time, 1)
+	go func() {
+		if err := backup.waitForMastership(ctx); err != nil {
+			masterChan <- time.Time{}
+			return
+		}
+		masterChan <- time.Now()
+	}()
+
+	fmt.Printf("Failing over from %s to %s after %d writes\n", primary.name, backup.name, at)
+	start := time.Now()
+	if err := primary.fail(); err != nil {
+		panic(err)
+	}
+
+	// Keep writing through the backup until the switch accepts its writes. Only
+	// writes sent to the switch are counted as rejected: until the backup is master,
+	// its client fails them without sending them.
+	var rejected int
+	tookOver := backup.takeOver == nil
+	for {
+		if ctx.Err() != nil {
+			panic(fmt.Errorf("%s did not take over: %v", backup.name, ctx.Err()))
+		}
+		if !tookOver && backup.isMaster() {
+			if err := backup.takeOver(); err != nil {
+				panic(err)
+			}
+			tookOver = true
+		}
+		if !backup.isMaster() {
+			time.Sleep(retryInterval)
+			continue
+		}
+		if backup.write(at) == codes.OK {
+			break
+		}
+		rejected++
+		time.Sleep(retryInterval)
+	}
+	resumed := time.Since(start)
+	masterAt := <-masterChan
+	mastership := masterAt.Sub(start)
+	if mastership < 0 {
+		mastership = 0 // the backup was master all along
+	}
+
+	for i := at + 1; i < iterations; i++ {
+		if backup.write(i) != codes.OK {
+			failed++
+		}
+	}
+
+	if backup.alwaysMaster {
+		fmt.Printf("Time until %s was master: not measured, every %s client is master\n", backup.name, api)
+	} else {
+		fmt.Printf("Time until %s was master: %v\n", backup.name, mastership)
+	}
+	fmt.Printf("Time until %s resumed writes: %v\n", backup.name, resumed)
+	fmt.Printf("Writes rejected by the switch during failover: %d\n", rejected)
+	fmt.Printf("Number of failed writes: %d\n", failed)
+
+	fileName := fmt.Sprintf("failover-result-%s-%d-%d-%d.csv", api, controllers, iterations, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	resultWriter := csv.NewWriter(csvFile)
+	resultWriter.Write([]string{"Metric", "Value"})
+	if !backup.alwaysMaster {
+		resultWriter.Write([]string{"µs until backup was master", strconv.FormatInt(mastership.Microseconds(), 10)})
+	}
+	resultWriter.Write([]string{"µs until backup resumed writes", strconv.FormatInt(resumed.Microseconds(), 10)})
+	resultWriter.Write([]string{"Writes rejected by the switch during failover", strconv.Itoa(rejected)})
+	resultWriter.Write([]string{"Failed writes", strconv.Itoa(failed)})
+	resultWriter.Flush()
+}
+
+// bfrtControllers connects one BfRuntime client per controller, with consecutive
+// client IDs. The primary binds the pipeline; a backup binds it again when taking over.
+func bfrtControllers() []controller {
+	clients := make([]bfrt.BFRuntimeClient, controllers)
+	for k := range clients {
+		clients[k] = connectBFRuntime(bfrt.ClientOptions{
+			Host:       target,
+			DeviceId:   deviceId,
+			ClientId:   clientId + uint32(k),
+			P4Name:     p4Name,
+			BatchSize:  batchSize,
+			NumThreads: numThreads,
+			NoCache:    true,
+		})
+	}
+
+	bindPipeline(clients[0])
+
+	ctrls := make([]controller, len(clients))
+	for k, client := range clients {
+		client := client
+		requests := BuildTableEntries(client, iterations, batchSize)
+		ctrls[k] = controller{
+			name:              fmt.Sprintf("client %d", client.ClientId()),
+			alwaysMaster:      true,
+			isMaster:          client.IsMaster,
+			waitForMastership: client.WaitForMastership,
+			write: func(i int) codes.Code {
+				return firstBFRuntimeFailure(<-client.Write(requests[i]))
+			},
+			takeOver: client.SetForwardingPipelineConfig,
+			fail:     client.Close,
+			close:    client.Close,
+		}
+	}
+	return ctrls
+}
+
+// p4rtControllers connects one P4Runtime client per controller. The primary has
+// the highest election ID, and the first backup the next highest.
+func p4rtControllers() []controller {
+	helper := &p4rt.P4InfoHelper{}
+	err := helper.Init(p4InfoPath)
+	if err != nil {
+		panic(err)
+	}
+
+	clients := make([]p4rt.P4RuntimeClient, controllers)
+	for k := range clients {
+		clients[k] = connectP4Runtime(p4rt.ClientOptions{
+			Host:               target,
+			DeviceID:           uint64(deviceId),
+			RoleID:             roleId,
+			DeviceConfigTarget: deviceTarget,
+			BatchSize:          batchSize,
+			NumThreads:         numThreads,
+			NoCache:            true,
+		}, uint64(controllers+1-k))
+	}
+
+	ctx, cancel := rpcContext()
+	err = clients[0].WaitForMastership(ctx)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	if deviceConfig != "" {
+		ctx, cancel := rpcContext()
+		start := time.Now()
+		pushed, err := clients[0].UpdatePipelineConfigContext(ctx, p4InfoPath, deviceConfig, forcePush)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		logPipelinePush(p4InfoPath, pushed, time.Since(start))
+	}
+
+	ctrls := make([]controller, len(clients))
+	for k, client := range clients {
+		client := client
+		requests := BuildP4RuntimeTableEntries(client, helper, iterations, batchSize)
+		fail := client.Close
+		if demote {
+			fail = func() error {
+				// Every backup has a higher election ID than 1
+				return client.SetMastership(p4v1.Uint128{High: 0, Low: 1})
+			}
+		}
+		ctrls[k] = controller{
+			name:              fmt.Sprintf("election ID %d", client.ElectionID().GetLow()),
+			isMaster:          client.IsMaster,
+			waitForMastership: client.WaitForMastership,
+			write: func(i int) codes.Code {
+				return firstP4RuntimeFailure(<-client.Write(requests[i]))
+			},
+			fail:  fail,
+			close: client.Close,
+		}
+	}
+	return ctrls
+}
+
+func firstBFRuntimeFailure(errors []*p4.Error) codes.Code {
+	for _, err := range errors {
+		if err.GetCanonicalCode() != int32(codes.OK) {
+			return codes.Code(err.GetCanonicalCode())
+		}
+	}
+	return codes.OK
+}
+
+func firstP4RuntimeFailure(errors []*p4v1.Error) codes.Code {
+	for _, err := range errors {
+		if err.GetCanonicalCode() != int32(codes.OK) {
+			return codes.Code(err.GetCanonicalCode())
+		}
+	}
+	return codes.OK
+}
@@ -0,0 +1,429 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/bfrt-perf/p4rt"
+	"github.com/P4Networking/pisc/util"
+	f "github.com/P4Networking/pisc/util/enums"
+	"github.com/P4Networking/proto/go/p4"
+	p4v1 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// Fields of the BfRuntime action profile and selector tables
+const (
+	actionMemberID     = "$ACTION_MEMBER_ID"
+	actionMemberStatus = "$ACTION_MEMBER_STATUS"
+	selectorGroupID    = "$SELECTOR_GROUP_ID"
+	maxGroupSize       = "$MAX_GROUP_SIZE"
+)
+
+// groupTarget writes the members and groups of an action selector, and the table
+// entries pointing at the groups, through one API. Members and groups are numbered
+// from 1. The update types of both APIs have the same values, so BfRuntime's are
+// used for both.
+type groupTarget struct {
+	writeMembers func(updateType p4.Update_Type, count int) error
+	writeGroup   func(updateType p4.Update_Type, group uint32, members []uint32) error
+	writeEntries func(updateType p4.Update_Type, count int) error // entry i points at group i+1; nil without -table
+	close        func() error
+}
+
+// runGroupBenchmark measures how fast ECMP groups can be reprogrammed. It inserts
+// -members members into -actionProfile and -groups groups of -groupSize members,
+// pointed at by one entry of -table each if set. Then, for -iterations rounds, each
+// group has a member replaced by the next one, and the latency of every group
+// modification is recorded. Everything is deleted at the end.
+func runGroupBenchmark() {
+	// A group of every member would get the same members back each round
+	if groupSize < 1 || groupSize >= numMembers {
+		panic(fmt.Errorf("-groupSize must be between 1 and -members (%d) minus 1", numMembers))
+	}
+	var t groupTarget
+	switch api {
+	case "bfrt":
+		t = bfrtGroupTarget()
+	case "p4rt":
+		t = p4rtGroupTarget()
+	default:
+		panic(fmt.Errorf("unknown API %q", api))
+	}
+	defer t.close()
+
+	start := time.Now()
+	if err := t.writeMembers(p4.Update_INSERT, numMembers); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Inserted %d members in %v\n", numMembers, time.Since(start))
+
+	var creates []time.Duration
+	for g := 1; g <= numGroups; g++ {
+		start := time.Now()
+		if err := t.writeGroup(p4.Update_INSERT, uint32(g), groupMembers(g, 0)); err != nil {
+			panic(err)
+		}
+		creates = append(creates, time.Since(start))
+	}
+	fmt.Printf("Group creation latency: %v\n", summarize(creates))
+
+	if t.writeEntries != nil {
+		start := time.Now()
+		if err := t.writeEntries(p4.Update_INSERT, numGroups); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Inserted %d entries pointing at the groups in %v\n", numGroups, time.Since(start))
+	}
+
+	var modifies []time.Duration
+	var failed int
+	var rows [][]string
+	for round := 1; round <= iterations; round++ {
+		for g := 1; g <= numGroups; g++ {
+			start := time.Now()
+			err := t.writeGroup(p4.Update_MODIFY, uint32(g), groupMembers(g, round))
+			d := time.Since(start)
+			row := []string{strconv.Itoa(round), strconv.Itoa(g), strconv.FormatInt(d.Microseconds(), 10), ""}
+			if err != nil {
+				failed++
+				row[3] = err.Error()
+			} else {
+				modifies = append(modifies, d)
+			}
+			rows = append(rows, row)
+		}
+		fmt.Printf("\033[2K\rRound %d of %d...", round, iterations)
+	}
+	fmt.Printf("\033[2K\r")
+	fmt.Printf("Group membership change latency: %v\n", summarize(modifies))
+	fmt.Printf("Number of failed group changes: %d\n", failed)
+	fmt.Printf("Number of stream errors: %v\n", &streamErrors)
+
+	// Delete in reverse order of the references
+	if t.writeEntries != nil {
+		if err := t.writeEntries(p4.Update_DELETE, numGroups); err != nil {
+			fmt.Printf("error deleting entries: %v\n", err)
+		}
+	}
+	for g := 1; g <= numGroups; g++ {
+		if err := t.writeGroup(p4.Update_DELETE, uint32(g), nil); err != nil {
+			fmt.Printf("error deleting group %d: %v\n", g, err)
+		}
+	}
+	if err := t.writeMembers(p4.Update_DELETE, numMembers); err != nil {
+		fmt.Printf("error deleting members: %v\n", err)
+	}
+
+	fileName := fmt.Sprintf("group-result-%s-%d-%d-%d.csv", api, numGroups, groupSize, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	defer writer.Flush()
+	writer.Write([]string{"Round", "Group", "µs/group change", "Error"})
+	writer.WriteAll(rows)
+}
+
+// groupMembers returns the members of group g after round rounds of churn: a window
+// of -groupSize consecutive members, which slides by one member each round.
+func groupMembers(g, round int) []uint32 {
+	ids := make([]uint32, groupSize)
+	for j := range ids {
+		ids[j] = uint32(((g-1)*groupSize+round+j)%numMembers + 1)
+	}
+	return ids
+}
+
+// bfrtGroupTarget writes members to the -actionProfile table and groups to the
+// -selector table.
+func bfrtGroupTarget() groupTarget {
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: 1,
+	})
+	bindPipeline(client)
+
+	profile, err := p4infoHelper.GetTable(actionProfile)
+	if err != nil {
+		panic(err)
+	}
+	action, err := profile.GetAction(workloadAction)
+	if err != nil {
+		panic(err)
+	}
+	memberKey, err := profile.GetKey(actionMemberID)
+	if err != nil {
+		panic(err)
+	}
+	selector, err := p4infoHelper.GetTable(selectorName)
+	if err != nil {
+		panic(err)
+	}
+	groupKey, err := selector.GetKey(selectorGroupID)
+	if err != nil {
+		panic(err)
+	}
+	var groupFields [3]*bfrt.FieldInfo
+	for i, name := range []string{maxGroupSize, actionMemberID, actionMemberStatus} {
+		groupFields[i], err = selector.GetDataField(name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	write := func(updates []*p4.Update) error {
+		return bfrtWriteError(<-client.Write(&p4.WriteRequest{
+			ClientId: client.ClientId(),
+			Target: &p4.TargetDevice{
+				DeviceId: client.DeviceID(),
+				PipeId:   0xffff,
+			},
+			Updates: updates,
+		}))
+	}
+	tableUpdate := func(updateType p4.Update_Type, entry *p4.TableEntry) *p4.Update {
+		return &p4.Update{
+			Type:   updateType,
+			Entity: &p4.Entity{Entity: &p4.Entity_TableEntry{TableEntry: entry}},
+		}
+	}
+
+	t := groupTarget{close: client.Close}
+	t.writeMembers = func(updateType p4.Update_Type, count int) error {
+		for first := 1; first <= count; first += batchSize {
+			var updates []*p4.Update
+			for id := first; id < first+batchSize && id <= count; id++ {
+				entry := &p4.TableEntry{
+					TableId: profile.ID,
+					Key: &p4.TableKey{Fields: []*p4.KeyField{
+						util.GenKeyField(f.MATCH_EXACT, memberKey.ID, fieldBytes(uint64(id), memberKey.Type.Bits())),
+					}},
+				}
+				if updateType != p4.Update_DELETE {
+					entry.Data = &p4.TableData{ActionId: action.ID, Fields: memberParams(action.Data, id)}
+				}
+				updates = append(updates, tableUpdate(updateType, entry))
+			}
+			if err := write(updates); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t.writeGroup = func(updateType p4.Update_Type, group uint32, members []uint32) error {
+		entry := &p4.TableEntry{
+			TableId: selector.ID,
+			Key: &p4.TableKey{Fields: []*p4.KeyField{
+				util.GenKeyField(f.MATCH_EXACT, groupKey.ID, fieldBytes(uint64(group), groupKey.Type.Bits())),
+			}},
+		}
+		if updateType != p4.Update_DELETE {
+			status := make([]bool, len(members))
+			for i := range status {
+				status[i] = true
+			}
+			entry.Data = &p4.TableData{Fields: []*p4.DataField{
+				util.GenDataField(groupFields[0].ID, fieldBytes(uint64(groupSize), groupFields[0].Type.Bits())),
+				{FieldId: groupFields[1].ID, Value: &p4.DataField_IntArrVal{IntArrVal: &p4.DataField_IntArray{Val: members}}},
+				{FieldId: groupFields[2].ID, Value: &p4.DataField_BoolArrVal{BoolArrVal: &p4.DataField_BoolArray{Val: status}}},
+			}}
+		}
+		return write([]*p4.Update{tableUpdate(updateType, entry)})
+	}
+	if workloadTable != "" {
+		builder, err := newTableEntryBuilder(workloadTable, "")
+		if err != nil {
+			panic(err)
+		}
+		groupField, err := builder.table.GetDataField(selectorGroupID)
+		if err != nil {
+			panic(err)
+		}
+		t.writeEntries = func(updateType p4.Update_Type, count int) error {
+			req, err := builder.build(client, updateType, 0, count)
+			if err != nil {
+				return err
+			}
+			for i, update := range req.Updates {
+				if updateType != p4.Update_DELETE {
+					group := fieldBytes(uint64(i+1), groupField.Type.Bits())
+					update.GetEntity().GetTableEntry().Data = &p4.TableData{
+						Fields: []*p4.DataField{util.GenDataField(groupField.ID, group)},
+					}
+				}
+			}
+			return bfrtWriteError(<-client.Write(req))
+		}
+	}
+	return t
+}
+
+// p4rtGroupTarget writes the members and groups of the -actionProfile action
+// profile, which holds both in P4Runtime.
+func p4rtGroupTarget() groupTarget {
+	helper := &p4rt.P4InfoHelper{}
+	err := helper.Init(p4InfoPath)
+	if err != nil {
+		panic(err)
+	}
+	client := connectP4Runtime(p4rt.ClientOptions{
+		Host:               target,
+		DeviceID:           uint64(deviceId),
+		RoleID:             roleId,
+		DeviceConfigTarget: deviceTarget,
+		BatchSize:          batchSize,
+		NumThreads:         1,
+	}, 1)
+	ctx, cancel := rpcContext()
+	err = client.WaitForMastership(ctx)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	if deviceConfig != "" {
+		ctx, cancel := rpcContext()
+		start := time.Now()
+		pushed, err := client.UpdatePipelineConfigContext(ctx, p4InfoPath, deviceConfig, forcePush)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		logPipelinePush(p4InfoPath, pushed, time.Since(start))
+	}
+
+	// P4Info names are not prefixed with the pipeline name
+	profile, err := helper.GetActionProfile(strings.TrimPrefix(actionProfile, "pipe."))
+	if err != nil {
+		panic(err)
+	}
+	if !profile.GetWithSelector() {
+		panic(fmt.Errorf("action profile %s has no selector", profile.GetPreamble().GetName()))
+	}
+	profileID := profile.GetPreamble().GetId()
+	action, err := helper.GetAction(workloadAction)
+	if err != nil {
+		panic(err)
+	}
+
+	write := func(updates []*p4v1.Update) error {
+		return p4rtWriteError(<-client.Write(&p4v1.WriteRequest{
+			DeviceId:   client.DeviceID(),
+			ElectionId: client.ElectionID(),
+			Updates:    updates,
+		}))
+	}
+
+	t := groupTarget{close: client.Close}
+	t.writeMembers = func(updateType p4.Update_Type, count int) error {
+		for first := 1; first <= count; first += batchSize {
+			var updates []*p4v1.Update
+			for id := first; id < first+batchSize && id <= count; id++ {
+				member := &p4v1.ActionProfileMember{ActionProfileId: profileID, MemberId: uint32(id)}
+				if updateType != p4.Update_DELETE {
+					params := make([]*p4v1.Action_Param, len(action.GetParams()))
+					for i, param := range action.GetParams() {
+						params[i] = &p4v1.Action_Param{ParamId: param.GetId(), Value: memberParam(i, id, int(param.GetBitwidth()))}
+					}
+					member.Action = &p4v1.Action{ActionId: action.GetPreamble().GetId(), Params: params}
+				}
+				updates = append(updates, &p4v1.Update{
+					Type:   p4v1.Update_Type(updateType),
+					Entity: &p4v1.Entity{Entity: &p4v1.Entity_ActionProfileMember{ActionProfileMember: member}},
+				})
+			}
+			if err := write(updates); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t.writeGroup = func(updateType p4.Update_Type, group uint32, members []uint32) error {
+		g := &p4v1.ActionProfileGroup{ActionProfileId: profileID, GroupId: group}
+		if updateType != p4.Update_DELETE {
+			g.MaxSize = int32(groupSize)
+			for _, id := range members {
+				g.Members = append(g.Members, &p4v1.ActionProfileGroup_Member{MemberId: id, Weight: 1})
+			}
+		}
+		return write([]*p4v1.Update{{
+			Type:   p4v1.Update_Type(updateType),
+			Entity: &p4v1.Entity{Entity: &p4v1.Entity_ActionProfileGroup{ActionProfileGroup: g}},
+		}})
+	}
+	if workloadTable != "" {
+		builder, err := newP4RuntimeEntryBuilder(helper, workloadTable, "")
+		if err != nil {
+			panic(err)
+		}
+		t.writeEntries = func(updateType p4.Update_Type, count int) error {
+			req, err := builder.build(client, p4v1.Update_Type(updateType), 0, count)
+			if err != nil {
+				return err
+			}
+			for i, update := range req.Updates {
+				if updateType != p4.Update_DELETE {
+					update.GetEntity().GetTableEntry().Action = &p4v1.TableAction{
+						Type: &p4v1.TableAction_ActionProfileGroupId{ActionProfileGroupId: uint32(i + 1)},
+					}
+				}
+			}
+			return p4rtWriteError(<-client.Write(req))
+		}
+	}
+	return t
+}
+
+// memberParams sets the first parameter of the action of member id to id, so that
+// every member forwards differently, and the others to zero.
+func memberParams(params []bfrt.FieldInfo, id int) []*p4.DataField {
+	fields := make([]*p4.DataField, len(params))
+	for i, param := range params {
+		fields[i] = util.GenDataField(param.ID, memberParam(i, id, param.Type.Bits()))
+	}
+	return fields
+}
+
+func memberParam(i, id, width int) []byte {
+	if i == 0 {
+		return fieldBytes(uint64(id), width)
+	}
+	return fieldBytes(0, width)
+}
+
+// bfrtWriteError returns the first failure of a BfRuntime write, if any.
+func bfrtWriteError(errors []*p4.Error) error {
+	for _, err := range errors {
+		if code := codes.Code(err.GetCanonicalCode()); code != codes.OK {
+			return fmt.Errorf("%v: %s", code, err.GetMessage())
+		}
+	}
+	return nil
+}
+
+// p4rtWriteError is the P4Runtime equivalent of bfrtWriteError.
+func p4rtWriteError(errors []*p4v1.Error) error {
+	for _, err := range errors {
+		if code := codes.Code(err.GetCanonicalCode()); code != codes.OK {
+			return fmt.Errorf("%v: %s", code, err.GetMessage())
+		}
+	}
+	return nil
+}
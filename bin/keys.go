@@ -0,0 +1,146 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// Widths of the key fields whose values may be written as addresses
+const (
+	ipv4Width = 8 * net.IPv4len
+	ipv6Width = 8 * net.IPv6len
+	macWidth  = 48
+)
+
+// parseFieldValue parses a value of a width-bit key field: an IPv4 address for
+// 32-bit fields, an IPv6 address for 128-bit fields, a MAC address for 48-bit
+// fields, and an integer (decimal, or hexadecimal prefixed with 0x) for any field.
+func parseFieldValue(s string, width int) (*big.Int, error) {
+	var value []byte
+	switch ip := net.ParseIP(s); {
+	case width == ipv4Width && ip != nil && ip.To4() != nil:
+		value = ip.To4()
+	case width == ipv6Width && ip != nil:
+		value = ip.To16()
+	case width == macWidth && strings.ContainsAny(s, ":-."):
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		value = mac
+	}
+	if value != nil {
+		return new(big.Int).SetBytes(value), nil
+	}
+	v, ok := new(big.Int).SetString(s, 0)
+	if !ok || v.Sign() < 0 {
+		return nil, fmt.Errorf("invalid value %q for a %d-bit field", s, width)
+	}
+	if v.BitLen() > width {
+		return nil, fmt.Errorf("%s does not fit in a %d-bit field", s, width)
+	}
+	return v, nil
+}
+
+// formatFieldValue is the inverse of parseFieldValue, for logging keys.
+func formatFieldValue(value []byte, width int) string {
+	switch {
+	case width == ipv4Width && len(value) == net.IPv4len, width == ipv6Width && len(value) == net.IPv6len:
+		return net.IP(value).String()
+	case width == macWidth && len(value) == 6:
+		return net.HardwareAddr(value).String()
+	}
+	return fmt.Sprintf("%#x", new(big.Int).SetBytes(value))
+}
+
+// formatKey describes a generated key, e.g. dst_addr=2001:db8::/48 for an LPM field.
+func formatKey(fields []matchField, key []fieldMatch) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		m := key[i]
+		value := formatFieldValue(m.value, field.width)
+		switch field.matchType {
+		case matchLPM:
+			value = fmt.Sprintf("%s/%d", value, m.prefixLen)
+		case matchTernary:
+			value = fmt.Sprintf("%s&&&%s", value, formatFieldValue(m.mask, field.width))
+		case matchRange:
+			value = fmt.Sprintf("%s..%s", value, formatFieldValue(m.high, field.width))
+		}
+		parts[i] = lastComponent(field.name) + "=" + value
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseKeyBases parses the -keyBases flag, a comma-separated list of field=value
+// pairs, into the first value of each named field. Fields are named in full or by
+// their last component, e.g. dst_addr for hdr.ipv6.dst_addr.
+func parseKeyBases(s string, fields []matchField) ([]*big.Int, error) {
+	bases := make([]*big.Int, len(fields))
+	if s == "" {
+		return bases, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid field=value pair %q", item)
+		}
+		found := false
+		for i, field := range fields {
+			if field.name != parts[0] && lastComponent(field.name) != parts[0] {
+				continue
+			}
+			v, err := parseFieldValue(parts[1], field.width)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", field.name, err)
+			}
+			bases[i] = v
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no key field %s", parts[0])
+		}
+	}
+	return bases, nil
+}
+
+// offsetKey returns base+n in a width-bit field, wrapping around at the top of the
+// field. A nil base counts from zero.
+func offsetKey(base, n *big.Int, width int) *big.Int {
+	v := new(big.Int).Set(n)
+	if base != nil {
+		v.Add(v, base)
+	}
+	return v.And(v, lowBits(width))
+}
+
+// prefixKey returns the n-th prefix of prefixLen bits from the prefix of base, in a
+// width-bit field. The bits of base past the prefix are cleared.
+func prefixKey(base, n *big.Int, width, prefixLen int) *big.Int {
+	shift := uint(width - prefixLen)
+	v := new(big.Int)
+	if base != nil {
+		v.Rsh(base, shift)
+	}
+	v.Add(v, n)
+	v.And(v, lowBits(prefixLen))
+	return v.Lsh(v, shift)
+}
+
+// lowBits returns a value with the n lowest bits set.
+func lowBits(n int) *big.Int {
+	v := new(big.Int).Lsh(big.NewInt(1), uint(n))
+	return v.Sub(v, big.NewInt(1))
+}
+
+// bigBytes encodes v in network byte order in the bytes of a width-bit field.
+func bigBytes(v *big.Int, width int) []byte {
+	return v.FillBytes(make([]byte, (width+7)/8))
+}
@@ -0,0 +1,95 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestPrefixKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		n         int64
+		width     int
+		prefixLen int
+		want      string
+	}{
+		{name: "from zero", n: 3, width: 32, prefixLen: 24, want: "0x300"},
+		{name: "from a base", base: "10.0.0.0", n: 1, width: 32, prefixLen: 8, want: "0xb000000"},
+		{name: "host bits of the base cleared", base: "10.1.2.3", n: 0, width: 32, prefixLen: 16, want: "0xa010000"},
+		{name: "wraps around", base: "255.255.0.0", n: 1, width: 32, prefixLen: 16, want: "0x0"},
+		{name: "full length", base: "10.0.0.255", n: 1, width: 32, prefixLen: 32, want: "0xa000100"},
+		{name: "zero length", base: "10.0.0.0", n: 5, width: 32, prefixLen: 0, want: "0x0"},
+		{name: "ipv6", base: "2001:db8::", n: 1, width: 128, prefixLen: 48, want: "0x20010db8000100000000000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base *big.Int
+			if tt.base != "" {
+				var err error
+				base, err = parseFieldValue(tt.base, tt.width)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := prefixKey(base, big.NewInt(tt.n), tt.width, tt.prefixLen)
+			if s := "0x" + got.Text(16); s != tt.want {
+				t.Errorf("prefixKey() = %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldValue(t *testing.T) {
+	tests := []struct {
+		s       string
+		width   int
+		want    string
+		wantErr bool
+	}{
+		{s: "10.0.0.1", width: 32, want: "0xa000001"},
+		{s: "2001:db8::1", width: 128, want: "0x20010db8000000000000000000000001"},
+		{s: "00:00:5e:00:53:01", width: 48, want: "0x5e005301"},
+		{s: "0x10", width: 9, want: "0x10"},
+		{s: "511", width: 9, want: "0x1ff"},
+		{s: "512", width: 9, wantErr: true},
+		{s: "10.0.0.1", width: 16, wantErr: true},
+		{s: "-1", width: 8, wantErr: true},
+		{s: "x", width: 8, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseFieldValue(tt.s, tt.width)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFieldValue(%q, %d) error = %v, wantErr %v", tt.s, tt.width, err, tt.wantErr)
+			}
+			if err == nil && "0x"+got.Text(16) != tt.want {
+				t.Errorf("parseFieldValue(%q, %d) = %#x, want %s", tt.s, tt.width, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeyBases(t *testing.T) {
+	fields := []matchField{
+		{name: "hdr.ipv4.dst_addr", matchType: matchLPM, width: 32},
+		{name: "vrf", matchType: matchExact, width: 8},
+	}
+	bases, err := parseKeyBases("dst_addr=10.0.0.0, vrf=0x10", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bases[0].Int64() != 0x0a000000 || bases[1].Int64() != 0x10 {
+		t.Errorf("parseKeyBases() = %v, want [167772160 16]", bases)
+	}
+	for _, s := range []string{"src_addr=10.0.0.0", "vrf", "vrf=256"} {
+		if _, err := parseKeyBases(s, fields); err == nil {
+			t.Errorf("parseKeyBases(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/csv"
 	"flag"
@@ -14,19 +15,28 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/bfrt-perf/p4rt"
 	f "github.com/P4Networking/pisc/util/enums"
 	"github.com/P4Networking/proto/go/p4"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc/codes"
 )
 
+// Table and action written by the tests
+const (
+	tableName  = "pipe.SwitchIngress.rib_24"
+	actionName = "SwitchIngress.hit_route_port"
+)
+
 var writeReples sync.WaitGroup
 var failedWrites uint32
+var timedOutWrites uint32
 var p4infoHelper bfrt.P4InfoHelper
 
 var (
@@ -35,9 +45,71 @@ var (
 	batchSize  int
 	numThreads int
 	p4Name     string
+	mode       string
+
+	// Failover test
+	api           string
+	controllers   int
+	failoverAt    int
+	demote        bool
+	retryInterval time.Duration
+	p4InfoPath    string
+	deviceConfig  string
+	deviceTarget  string
+
+	// Notification tests
+	duration         time.Duration
+	ttl              time.Duration
+	ttlQueryInterval time.Duration
+	learnTable       string
+	learnAction      string
+
+	// Pipeline test
+	buildDir        string
+	pipelineActions string
+	basePath        string
+	forcePush       bool
+	dumpFile        string
+
+	// Push test
+	pushPrograms     string
+	pushWriteTimeout time.Duration
+
+	// Workload of the table tests
+	workloadTable  string
+	workloadAction string
+	prefixLengths  string
+	maskLengths    string
+	rangeSize      uint64
+	priorityOrder  string
+	keyBases       string
+	routesPath     string
+	routeFormat    string
+	routeSample    int
+	nextHopParam   string
+
+	// Group test
+	actionProfile string
+	selectorName  string
+	numMembers    int
+	numGroups     int
+	groupSize     int
+
+	// Capacity test
+	capacityLimit uint64
+
+	// Packet I/O test
+	packetPort         uint
+	packetPortMetadata string
+	packetSize         int
+
+	dialTimeout  time.Duration
+	rpcTimeout   time.Duration
+	writeTimeout time.Duration
 
 	clientId uint32 = 0
 	deviceId uint32 = 0
+	roleId   uint64 = 0
 )
 
 func init() {
@@ -46,27 +118,188 @@ func init() {
 	flag.IntVar(&batchSize, "batchSize", 100, "Number of table entries per batch")
 	flag.IntVar(&numThreads, "numThreads", 1, "Number of threads to send write request")
 	flag.StringVar(&p4Name, "p4Name", "", "Name of p4 program")
+	flag.StringVar(&mode, "mode", "write", "Test to run: write, failover, digest, aging, packet, pipeline, push, capacity, groups or dump")
+	flag.StringVar(&api, "api", "bfrt", "API used by the failover, push, groups and dump tests: bfrt or p4rt")
+	flag.IntVar(&controllers, "controllers", 2, "Number of controllers in the failover test; the first one is primary")
+	flag.IntVar(&failoverAt, "failoverAt", -1, "Write request at which the primary fails over. By default, half of iterations")
+	flag.BoolVar(&demote, "demote", false, "Demote the primary with a lower election ID instead of closing it (p4rt only)")
+	flag.DurationVar(&retryInterval, "retryInterval", time.Millisecond, "Interval between retried writes in the failover and push tests")
+	flag.StringVar(&p4InfoPath, "p4info", "", "P4Info text file used by p4rt")
+	flag.StringVar(&deviceConfig, "deviceConfig", "", "Device config pushed by p4rt. If empty, the pipeline on the switch is used")
+	flag.StringVar(&deviceTarget, "deviceTarget", "stratum_bfrt", "Format of -deviceConfig: "+strings.Join(p4rt.DeviceConfigTargets(), ", "))
+	flag.DurationVar(&dialTimeout, "dialTimeout", 10*time.Second, "Time allowed to connect to the switch (0 to connect in the background)")
+	flag.DurationVar(&rpcTimeout, "rpcTimeout", 60*time.Second, "Time allowed for mastership and pipeline RPCs (0 to wait forever)")
+	flag.DurationVar(&writeTimeout, "writeTimeout", 10*time.Second, "Time allowed for each write request (0 to wait forever)")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "How long notification tests listen for notifications")
+	flag.DurationVar(&ttl, "ttl", 0, "Idle timeout of the written entries. By default, entries do not age out")
+	flag.DurationVar(&ttlQueryInterval, "ttlQueryInterval", time.Second, "How often the switch checks for aged out entries in the aging test")
+	flag.StringVar(&learnTable, "learnTable", "", "Table the digest test programs learned entries into. If empty, entries are not programmed")
+	flag.StringVar(&learnAction, "learnAction", "", "Action of the entries programmed by the digest test")
+	flag.StringVar(&buildDir, "buildDir", "", "bf-p4c output directory of the program pushed by the BfRuntime tests. If empty, the client binds to -p4Name")
+	flag.StringVar(&pipelineActions, "pipelineActions", "verify,verify_and_warm_init_begin_and_end", "Comma-separated SetForwardingPipelineConfig actions run by the pipeline test")
+	flag.StringVar(&basePath, "basePath", "", "Directory the switch saves pushed programs in")
+	flag.BoolVar(&forcePush, "forcePush", false, "Push the pipeline even if the switch already runs it")
+	flag.StringVar(&pushPrograms, "pushPrograms", "", "Programs pushed in turn by the push test, separated by semicolons: bf-p4c output directories with -api bfrt, or <p4info>,<deviceConfig> with -api p4rt. By default, -buildDir or -p4info and -deviceConfig")
+	flag.DurationVar(&pushWriteTimeout, "pushWriteTimeout", 10*time.Second, "How long the push test retries the first write after each push")
+	flag.StringVar(&dumpFile, "dumpFile", "", "Device config file decoded by the dump test instead of the one on the switch")
+	flag.StringVar(&workloadTable, "table", "", "Table written by the table tests, with keys generated for its match types. By default, /24 routes in "+tableName)
+	flag.StringVar(&workloadAction, "action", actionName, "Action of the entries written to -table")
+	flag.StringVar(&prefixLengths, "prefixLengths", "", "Prefix lengths of LPM keys, as length:weight pairs, e.g. 24:60,22:25,16:15. By default, full-length prefixes")
+	flag.StringVar(&maskLengths, "maskLengths", "", "Number of leading bits matched by ternary keys, as length:weight pairs. By default, all bits")
+	flag.Uint64Var(&rangeSize, "rangeSize", 1, "Number of values matched by range keys")
+	flag.StringVar(&priorityOrder, "priority", "same", "Priorities of entries in tables needing one: same, increasing, decreasing or random")
+	flag.StringVar(&keyBases, "keyBases", "", "First value of key fields of -table, as field=value pairs, e.g. dst_addr=2001:db8::,dst_mac=00:00:5e:00:53:00. By default, zero")
+	flag.StringVar(&routesPath, "routes", "", "Prefix list or MRT RIB dump (optionally .gz or .bz2) whose routes are written to the LPM field of -table")
+	flag.StringVar(&routeFormat, "routeFormat", "auto", "Format of -routes: text, mrt or auto")
+	flag.IntVar(&routeSample, "routeSample", 0, "Number of routes drawn at random from -routes. By default, all routes are used")
+	flag.StringVar(&nextHopParam, "nextHopParam", "", "Action parameter set to the next hop of each route. By default, the first parameter")
+	flag.StringVar(&actionProfile, "actionProfile", "", "Action profile table the group test writes members to; with -api p4rt, the action profile holding members and groups")
+	flag.StringVar(&selectorName, "selector", "", "Selector table the group test writes groups to (bfrt only)")
+	flag.IntVar(&numMembers, "members", 64, "Number of action profile members written by the group test")
+	flag.IntVar(&numGroups, "groups", 16, "Number of selector groups written by the group test")
+	flag.IntVar(&groupSize, "groupSize", 8, "Number of members of each group in the group test")
+	flag.Uint64Var(&capacityLimit, "capacityLimit", 0, "Number of entries after which the capacity test stops. By default, twice the size of the table in bfrt.json")
+	flag.UintVar(&packetPort, "packetPort", 0, "Port the packet test sends packet-outs to; it should loop them back to the CPU")
+	flag.StringVar(&packetPortMetadata, "packetPortMetadata", "egress_port", "packet_out metadata holding the port in the packet test")
+	flag.IntVar(&packetSize, "packetSize", 64, "Size of the packets sent by the packet test")
+	flag.Uint64Var(&roleId, "roleId", 0, "P4Runtime role of the p4rt clients. By default, the full-pipeline role")
+	deviceIdFlag := flag.Uint("deviceId", 0, "Device ID of the switch")
 	flag.Parse()
+	deviceId = uint32(*deviceIdFlag)
 }
 
 func main() {
-	client, err := bfrt.CreateOrGetBFRuntimeClient(target, deviceId, batchSize, numThreads, p4Name)
+	if routesPath != "" && workloadTable == "" {
+		fmt.Fprintf(os.Stderr, "-routes needs a -table with an LPM field\n")
+		os.Exit(2)
+	}
+	switch mode {
+	case "write":
+		runWriteBenchmark()
+	case "failover":
+		runFailover()
+	case "digest":
+		runDigestBenchmark()
+	case "aging":
+		runAgingBenchmark()
+	case "packet":
+		runPacketBenchmark()
+	case "pipeline":
+		runPipelineBenchmark()
+	case "push":
+		runPushBenchmark()
+	case "capacity":
+		runCapacityBenchmark()
+	case "groups":
+		runGroupBenchmark()
+	case "dump":
+		runDump()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mode %q\n", mode)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// dialContext returns a context bounded by the -dialTimeout flag.
+func dialContext() (context.Context, context.CancelFunc) {
+	if dialTimeout > 0 {
+		return context.WithTimeout(context.Background(), dialTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// rpcContext returns a context bounded by the -rpcTimeout flag.
+func rpcContext() (context.Context, context.CancelFunc) {
+	if rpcTimeout > 0 {
+		return context.WithTimeout(context.Background(), rpcTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// logEvents prints stream and mastership changes, e.g. when the switch restarts
+// during the test.
+func logEvents(name string, eventChan <-chan bfrt.Event) {
+	for event := range eventChan {
+		logEvent(name, event.Time, event.Type, event.Err)
+	}
+}
+
+func logEvent(name string, t time.Time, eventType fmt.Stringer, err error) {
 	if err != nil {
-		panic(err)
+		fmt.Printf("\n%s: %s: %v: %v\n", t.Format(time.RFC3339Nano), name, eventType, err)
+	} else {
+		fmt.Printf("\n%s: %s: %v\n", t.Format(time.RFC3339Nano), name, eventType)
+	}
+}
+
+// logStreamStats prints how many notifications of each kind the client received and
+// dropped.
+func logStreamStats(stats []bfrt.StreamStats) {
+	for _, s := range stats {
+		fmt.Printf("Stream %s messages: %d received, %d dropped\n", s.Kind, s.Received, s.Dropped)
 	}
+}
 
-	err = client.SetMastership(clientId)
+// connectBFRuntime opens a BfRuntime client, subscribes and waits until it is master.
+func connectBFRuntime(opts bfrt.ClientOptions) bfrt.BFRuntimeClient {
+	dialCtx, cancel := dialContext()
+	client, err := bfrt.NewBFRuntimeClient(dialCtx, opts)
+	cancel()
 	if err != nil {
 		panic(err)
 	}
+	client.SetRPCTimeout(rpcTimeout)
+	client.SetWriteTimeout(writeTimeout)
 
-	time.Sleep(1 * time.Second)
+	eventChan := make(chan bfrt.Event, 100)
+	client.SetEventChan(eventChan)
+	go logEvents(fmt.Sprintf("client %d", opts.ClientId), eventChan)
 
-	err = client.SetForwardingPipelineConfig()
+	errorChan := make(chan bfrt.StreamError, 100)
+	client.SetStreamErrorChan(errorChan)
+	go func() {
+		for streamErr := range errorChan {
+			streamErrors.add(streamErr.RequestKind())
+		}
+	}()
+
+	err = client.SetMastership(opts.ClientId)
 	if err != nil {
 		panic(err)
 	}
 
+	mastershipCtx, cancel := rpcContext()
+	err = client.WaitForMastership(mastershipCtx)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// bindPipeline binds the client to the P4 program and loads its bfrt.json into p4infoHelper.
+// With -buildDir, the program is first pushed unless the switch already runs it.
+func bindPipeline(client bfrt.BFRuntimeClient) {
+	if buildDir != "" {
+		program, err := bfrt.LoadProgram(buildDir, p4Name)
+		if err != nil {
+			panic(err)
+		}
+		ctx, cancel := rpcContext()
+		pushed, push, err := client.UpdatePipelineConfigContext(ctx, p4.SetForwardingPipelineConfigRequest_VERIFY_AND_WARM_INIT_BEGIN_AND_END, program, forcePush)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		logPipelinePush(program.P4Name, pushed, push.Done)
+	} else {
+		err := client.SetForwardingPipelineConfig()
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	bfrtConfig, err := client.GetForwardingPipelineConfig()
 	if err != nil {
 		panic(err)
@@ -76,23 +309,59 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+}
+
+// logPipelinePush reports whether a pipeline was pushed or already on the switch.
+func logPipelinePush(name string, pushed bool, elapsed time.Duration) {
+	if pushed {
+		fmt.Printf("Pipeline %s pushed in %v\n", name, elapsed)
+	} else {
+		fmt.Printf("Pipeline %s already on the switch, not pushed\n", name)
+	}
+}
+
+// runWriteBenchmark measures the latency of table writes over a single BfRuntime client.
+func runWriteBenchmark() {
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     p4Name,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+	bindPipeline(client)
+
+	// Log link flaps, which may explain outliers in the write durations
+	var portEventsLock sync.Mutex
+	var portEvents []bfrt.PortStatus
+	portStatusChan := make(chan bfrt.PortStatus, 100)
+	client.SetPortStatusChan(portStatusChan)
+	go func() {
+		for portStatus := range portStatusChan {
+			fmt.Printf("\n%s: %v\n", portStatus.Received.Format(time.RFC3339Nano), portStatus)
+			portEventsLock.Lock()
+			portEvents = append(portEvents, portStatus)
+			portEventsLock.Unlock()
+		}
+	}()
 
 	// Set up write tracing for test
 	writeTraceChan := make(chan bfrt.WriteTrace, 1000)
 	client.SetWriteTraceChan(writeTraceChan)
-	doneChan := make(chan []time.Duration)
+	doneChan := make(chan []bfrt.WriteTrace)
 	go func() {
 		var currentIteration, lastCount int
 		printInterval := 1 * time.Second
 		ticker := time.Tick(printInterval)
-		durations := make([]time.Duration, iterations)
+		traces := make([]bfrt.WriteTrace, iterations)
 		for {
 			select {
 			case trace := <-writeTraceChan:
-				durations[currentIteration] = trace.Duration
+				traces[currentIteration] = trace
 				currentIteration++
 				if currentIteration == iterations {
-					doneChan <- durations
+					doneChan <- traces
 					return
 				} else if currentIteration > iterations {
 					// Should not happened
@@ -111,12 +380,20 @@ func main() {
 	SendTableEntries(client, iterations, batchSize)
 
 	// Wait for all writes to finish
-	durations := <-doneChan
+	traces := <-doneChan
 	writeReples.Wait()
+	if err := client.Close(); err != nil {
+		fmt.Printf("error closing client: %v\n", err)
+	}
 	fmt.Printf("Number of failed writes: %d\n", failedWrites)
+	fmt.Printf("Number of stream errors: %v\n", &streamErrors)
+	if timedOutWrites > 0 {
+		fmt.Printf("Number of timed out writes: %d\n", timedOutWrites)
+	}
 
 	// Writing to CSV file
-	fileName := fmt.Sprintf("test-result-%s-%d-%d-%d.csv", "Tofino", batchSize, iterations, time.Now().Unix())
+	now := time.Now().Unix()
+	fileName := fmt.Sprintf("test-result-%s-%d-%d-%d.csv", "Tofino", batchSize, iterations, now)
 	fmt.Printf("Saving results to %s\n", fileName)
 
 	csvFile, err := os.Create(fileName)
@@ -126,10 +403,20 @@ func main() {
 	}
 	resultWriter := csv.NewWriter(csvFile)
 
-	resultWriter.Write([]string{"Index of durations", "µs/per write request"})
+	portEventsLock.Lock()
+	defer portEventsLock.Unlock()
+	if len(portEvents) > 0 {
+		fmt.Printf("Port status changes during the test: %d\n", len(portEvents))
+		// Flaps between writes are in no write's row, so list every event as well
+		savePortEvents(fmt.Sprintf("port-events-%s-%d-%d-%d.csv", "Tofino", batchSize, iterations, now), portEvents)
+	}
+
+	resultWriter.Write([]string{"Index of durations", "µs/per write request", "Port events during write"})
 	var summary int64
-	for i, d := range durations {
-		data := []string{strconv.Itoa(i), strconv.FormatInt(d.Microseconds(), 10)}
+	for i, trace := range traces {
+		d := trace.Duration
+		data := []string{strconv.Itoa(i), strconv.FormatInt(d.Microseconds(), 10),
+			portEventsDuring(portEvents, trace.Start, trace.Start.Add(d))}
 		resultWriter.Write(data)
 		summary += d.Microseconds()
 	}
@@ -138,27 +425,101 @@ func main() {
 		float64(summary)/1000000, iterations, float64(int64(iterations)*1000000)/float64(summary))
 }
 
+// savePortEvents saves every port status change received during the test, with the
+// time it was received.
+func savePortEvents(fileName string, portEvents []bfrt.PortStatus) {
+	fmt.Printf("Saving port status changes to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	writer.Write([]string{"Received", "Port", "Status"})
+	for _, portStatus := range portEvents {
+		status := "down"
+		if portStatus.Up {
+			status = "up"
+		}
+		writer.Write([]string{portStatus.Received.Format(time.RFC3339Nano), strconv.FormatUint(uint64(portStatus.DevPort), 10), status})
+	}
+	writer.Flush()
+}
+
+// portEventsDuring lists the port status changes received between start and end.
+func portEventsDuring(portEvents []bfrt.PortStatus, start, end time.Time) string {
+	var during []string
+	for _, portStatus := range portEvents {
+		if !portStatus.Received.Before(start) && !portStatus.Received.After(end) {
+			during = append(during, portStatus.String())
+		}
+	}
+	return strings.Join(during, "; ")
+}
+
 // SendTableEntries writes multiple table entries to the routing_v4
 // table.
 func SendTableEntries(client bfrt.BFRuntimeClient, iterations int, batchSize int) {
+	requests := BuildTableEntries(client, iterations, batchSize)
+	for _, req := range requests {
+		res := client.Write(req)
+		go CountFailed(proto.Clone(req).(*p4.WriteRequest), res)
+	}
+}
+
+// BuildTableEntries prepares the write requests for SendTableEntries.
+func BuildTableEntries(client bfrt.BFRuntimeClient, iterations int, batchSize int) []*p4.WriteRequest {
+	if workloadTable != "" {
+		builder, err := newTableEntryBuilder(workloadTable, workloadAction)
+		if err != nil {
+			panic(err)
+		}
+		requests, err := builder.buildAll(client, iterations, batchSize)
+		if err != nil {
+			panic(err)
+		}
+		return requests
+	}
 
-	tableID, err := p4infoHelper.GetP4Id("pipe.SwitchIngress.rib_24")
+	tableID, err := p4infoHelper.GetP4Id(tableName)
 	if err != nil {
 		panic(err)
 	}
 
-	actionID, err := p4infoHelper.GetP4Id("SwitchIngress.hit_route_port")
+	actionID, err := p4infoHelper.GetP4Id(actionName)
 	if err != nil {
 		panic(err)
 	}
 
+	// Entries age out after -ttl, if set
+	var ttlField *bfrt.FieldInfo
+	if ttl > 0 {
+		table, err := p4infoHelper.GetTable(tableName)
+		if err != nil {
+			panic(err)
+		}
+		ttlField, err = table.GetDataField("$ENTRY_TTL")
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	// Prepare write requests for all iterations
 	requests := make([]*p4.WriteRequest, iterations)
 	for i := 0; i < iterations; i++ {
 		updates := make([]*p4.Update, batchSize)
 		for j := 0; j < batchSize; j++ {
-			ipOri := int2ip(uint32((i*batchSize + j)))
-			ip := net.IPv4(ipOri[1], ipOri[2], ipOri[3], ipOri[0])
+			// The /24 prefix of address n<<8, in network byte order
+			ip := int2ip(uint32(i*batchSize + j))
+
+			fields := []*p4.DataField{
+				util.GenDataField(1, util.Int16ToBytes(128)),
+			}
+			if ttlField != nil {
+				ttlMs := make([]byte, 4)
+				binary.BigEndian.PutUint32(ttlMs, uint32(ttl.Milliseconds()))
+				fields = append(fields, util.GenDataField(ttlField.ID, ttlMs))
+			}
 
 			updates[j] = &p4.Update{
 				Type: p4.Update_INSERT,
@@ -169,14 +530,12 @@ func SendTableEntries(client bfrt.BFRuntimeClient, iterations int, batchSize int
 							Fields: []*p4.KeyField{
 								util.GenKeyField(f.MATCH_EXACT,
 									1,
-									util.Ipv4ToBytes(ip.String())[0:3]),
+									ip[1:4]),
 							},
 						},
 						Data: &p4.TableData{
 							ActionId: actionID,
-							Fields: []*p4.DataField{
-								util.GenDataField(1, util.Int16ToBytes(128)),
-							},
+							Fields:   fields,
 						},
 					},
 				},
@@ -193,11 +552,7 @@ func SendTableEntries(client bfrt.BFRuntimeClient, iterations int, batchSize int
 		}
 		requests[i] = req
 	}
-
-	for _, req := range requests {
-		res := client.Write(req)
-		go CountFailed(proto.Clone(req).(*p4.WriteRequest), res)
-	}
+	return requests
 }
 
 func CountFailed(write *p4.WriteRequest, res <-chan []*p4.Error) {
@@ -206,6 +561,9 @@ func CountFailed(write *p4.WriteRequest, res <-chan []*p4.Error) {
 		update := write.Updates[i]
 		if err.CanonicalCode != int32(codes.OK) { // write failed
 			atomic.AddUint32(&failedWrites, 1)
+			if err.CanonicalCode == int32(codes.DeadlineExceeded) {
+				atomic.AddUint32(&timedOutWrites, 1)
+			}
 			fmt.Fprintf(os.Stderr, "%v -> %v\n", update, err.GetMessage())
 		}
 	}
@@ -0,0 +1,258 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/P4Networking/bfrt-perf/p4rt"
+	p4_config "github.com/p4lang/p4runtime/go/p4/config/v1"
+	p4v1 "github.com/p4lang/p4runtime/go/p4/v1"
+)
+
+// connectP4Runtime opens a P4Runtime client and sends its arbitration request.
+// It does not wait for mastership, as backup controllers never become master.
+func connectP4Runtime(opts p4rt.ClientOptions, electionID uint64) p4rt.P4RuntimeClient {
+	dialCtx, cancel := dialContext()
+	client, err := p4rt.NewP4RuntimeClient(dialCtx, opts)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	client.SetRPCTimeout(rpcTimeout)
+	client.SetWriteTimeout(writeTimeout)
+
+	eventChan := make(chan p4rt.Event, 100)
+	client.SetEventChan(eventChan)
+	go func() {
+		name := fmt.Sprintf("election ID %d", electionID)
+		for event := range eventChan {
+			logEvent(name, event.Time, event.Type, event.Err)
+		}
+	}()
+
+	errorChan := make(chan p4rt.StreamError, 100)
+	client.SetStreamErrorChan(errorChan)
+	go func() {
+		for streamErr := range errorChan {
+			streamErrors.add(streamErr.RequestKind())
+		}
+	}()
+
+	err = client.SetMastership(p4v1.Uint128{High: 0, Low: electionID})
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// logP4RuntimeStreamStats is the P4Runtime equivalent of logStreamStats.
+func logP4RuntimeStreamStats(stats []p4rt.StreamStats) {
+	for _, s := range stats {
+		fmt.Printf("Stream %s messages: %d received, %d dropped\n", s.Kind, s.Received, s.Dropped)
+	}
+}
+
+// BuildP4RuntimeTableEntries prepares the P4Runtime equivalent of the requests built
+// by BuildTableEntries.
+func BuildP4RuntimeTableEntries(client p4rt.P4RuntimeClient, helper *p4rt.P4InfoHelper, iterations int, batchSize int) []*p4v1.WriteRequest {
+	if workloadTable != "" {
+		builder, err := newP4RuntimeEntryBuilder(helper, workloadTable, workloadAction)
+		if err != nil {
+			panic(err)
+		}
+		requests, err := builder.buildAll(client, iterations, batchSize)
+		if err != nil {
+			panic(err)
+		}
+		return requests
+	}
+
+	// P4Info names are not prefixed with the pipeline name
+	tableID, err := helper.GetP4Id(strings.TrimPrefix(tableName, "pipe."))
+	if err != nil {
+		panic(err)
+	}
+
+	actionID, err := helper.GetP4Id(actionName)
+	if err != nil {
+		panic(err)
+	}
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, 128)
+
+	requests := make([]*p4v1.WriteRequest, iterations)
+	for i := 0; i < iterations; i++ {
+		updates := make([]*p4v1.Update, batchSize)
+		for j := 0; j < batchSize; j++ {
+			// Same /24 keys as BuildTableEntries
+			ip := int2ip(uint32(i*batchSize + j))
+
+			updates[j] = &p4v1.Update{
+				Type: p4v1.Update_INSERT,
+				Entity: &p4v1.Entity{Entity: &p4v1.Entity_TableEntry{
+					TableEntry: &p4v1.TableEntry{
+						TableId: tableID,
+						Match: []*p4v1.FieldMatch{{
+							FieldId: 1,
+							FieldMatchType: &p4v1.FieldMatch_Exact_{
+								Exact: &p4v1.FieldMatch_Exact{Value: ip[1:4]},
+							},
+						}},
+						Action: &p4v1.TableAction{Type: &p4v1.TableAction_Action{
+							Action: &p4v1.Action{
+								ActionId: actionID,
+								Params: []*p4v1.Action_Param{
+									{ParamId: 1, Value: port},
+								},
+							},
+						}},
+					},
+				}},
+			}
+		}
+		requests[i] = &p4v1.WriteRequest{
+			DeviceId:   client.DeviceID(),
+			ElectionId: client.ElectionID(),
+			Updates:    updates,
+		}
+	}
+	return requests
+}
+
+// p4rtEntryBuilder is the P4Runtime equivalent of tableEntryBuilder.
+type p4rtEntryBuilder struct {
+	table    *p4_config.Table
+	action   *p4_config.Action
+	workload *keyWorkload
+}
+
+func newP4RuntimeEntryBuilder(helper *p4rt.P4InfoHelper, tableName, actionName string) (*p4rtEntryBuilder, error) {
+	// P4Info names are not prefixed with the pipeline name
+	table, err := helper.GetTable(strings.TrimPrefix(tableName, "pipe."))
+	if err != nil {
+		return nil, err
+	}
+	// Without an action, the action of the entries is left to the caller
+	var action *p4_config.Action
+	if actionName != "" {
+		action, err = helper.GetTableAction(table, actionName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields := make([]matchField, len(table.GetMatchFields()))
+	var priority bool
+	for i, field := range table.GetMatchFields() {
+		fields[i] = matchField{
+			name:      field.GetName(),
+			matchType: strings.ToLower(field.GetMatchType().String()),
+			width:     int(field.GetBitwidth()),
+		}
+		switch fields[i].matchType {
+		case matchTernary, matchRange, matchOptional:
+			priority = true
+		}
+	}
+	workload, err := newKeyWorkload(fields, priority)
+	if err != nil {
+		return nil, err
+	}
+	return &p4rtEntryBuilder{table: table, action: action, workload: workload}, nil
+}
+
+// build returns a request with count updates of entries first to first+count-1.
+func (b *p4rtEntryBuilder) build(client p4rt.P4RuntimeClient, updateType p4v1.Update_Type, first uint64, count int) (*p4v1.WriteRequest, error) {
+	updates := make([]*p4v1.Update, count)
+	for i := range updates {
+		entry, err := b.entry(first + uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if updateType == p4v1.Update_DELETE {
+			entry.Action = nil
+		}
+		updates[i] = &p4v1.Update{
+			Type:   updateType,
+			Entity: &p4v1.Entity{Entity: &p4v1.Entity_TableEntry{TableEntry: entry}},
+		}
+	}
+	return &p4v1.WriteRequest{
+		DeviceId:   client.DeviceID(),
+		ElectionId: client.ElectionID(),
+		Updates:    updates,
+	}, nil
+}
+
+// buildAll prepares iterations requests of batchSize inserts.
+func (b *p4rtEntryBuilder) buildAll(client p4rt.P4RuntimeClient, iterations, batchSize int) ([]*p4v1.WriteRequest, error) {
+	requests := make([]*p4v1.WriteRequest, iterations)
+	for i := range requests {
+		req, err := b.build(client, p4v1.Update_INSERT, uint64(i*batchSize), batchSize)
+		if err != nil {
+			return nil, err
+		}
+		requests[i] = req
+	}
+	b.workload.logRange(b.table.GetPreamble().GetName(), uint64(iterations*batchSize))
+	return requests, nil
+}
+
+func (b *p4rtEntryBuilder) entry(n uint64) (*p4v1.TableEntry, error) {
+	matches, priority, err := b.workload.entry(n)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %v", b.table.GetPreamble().GetName(), err)
+	}
+	var fieldMatches []*p4v1.FieldMatch
+	for i, m := range matches {
+		field := b.workload.fields[i]
+		if m.wildcard(field) {
+			// Don't-care fields are omitted
+			continue
+		}
+		fm := &p4v1.FieldMatch{FieldId: b.table.GetMatchFields()[i].GetId()}
+		switch field.matchType {
+		case matchExact:
+			fm.FieldMatchType = &p4v1.FieldMatch_Exact_{Exact: &p4v1.FieldMatch_Exact{Value: m.value}}
+		case matchTernary:
+			fm.FieldMatchType = &p4v1.FieldMatch_Ternary_{Ternary: &p4v1.FieldMatch_Ternary{Value: m.value, Mask: m.mask}}
+		case matchLPM:
+			fm.FieldMatchType = &p4v1.FieldMatch_Lpm{Lpm: &p4v1.FieldMatch_LPM{Value: m.value, PrefixLen: int32(m.prefixLen)}}
+		case matchRange:
+			fm.FieldMatchType = &p4v1.FieldMatch_Range_{Range: &p4v1.FieldMatch_Range{Low: m.value, High: m.high}}
+		case matchOptional:
+			fm.FieldMatchType = &p4v1.FieldMatch_Optional_{Optional: &p4v1.FieldMatch_Optional{Value: m.value}}
+		default:
+			return nil, fmt.Errorf("unsupported match type %s of key %s in table %s", field.matchType, field.name, b.table.GetPreamble().GetName())
+		}
+		fieldMatches = append(fieldMatches, fm)
+	}
+
+	entry := &p4v1.TableEntry{
+		TableId:  b.table.GetPreamble().GetId(),
+		Match:    fieldMatches,
+		Priority: priority,
+	}
+	if b.action == nil {
+		return entry, nil
+	}
+	rt, routed := b.workload.route(n)
+	params := make([]*p4v1.Action_Param, len(b.action.GetParams()))
+	for i, param := range b.action.GetParams() {
+		value := fieldBytes(0, int(param.GetBitwidth()))
+		if routed && isNextHopParam(i, param.GetName()) {
+			value = nextHopValue(rt, int(param.GetBitwidth()))
+		}
+		params[i] = &p4v1.Action_Param{ParamId: param.GetId(), Value: value}
+	}
+	entry.Action = &p4v1.TableAction{Type: &p4v1.TableAction_Action{
+		Action: &p4v1.Action{ActionId: b.action.GetPreamble().GetId(), Params: params},
+	}}
+	return entry, nil
+}
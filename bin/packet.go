@@ -0,0 +1,166 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/p4rt"
+	p4v1 "github.com/p4lang/p4runtime/go/p4/v1"
+)
+
+// Ethertype of the test packets, reserved for local experiments
+const packetEthertype = 0x88b5
+
+// runPacketBenchmark sends -iterations packet-outs to -packetPort, which is expected
+// to loop them back to the controller, and measures the packet-out rate and the round
+// trip time of each packet that comes back as a packet-in.
+func runPacketBenchmark() {
+	if p4InfoPath == "" {
+		panic(fmt.Errorf("the packet test needs a -p4info"))
+	}
+	helper := &p4rt.P4InfoHelper{}
+	err := helper.Init(p4InfoPath)
+	if err != nil {
+		panic(err)
+	}
+
+	client := connectP4Runtime(p4rt.ClientOptions{
+		Host:               target,
+		DeviceID:           uint64(deviceId),
+		RoleID:             roleId,
+		DeviceConfigTarget: deviceTarget,
+		BatchSize:          batchSize,
+		NumThreads:         numThreads,
+	}, 1)
+	defer client.Close()
+	ctx, cancel := rpcContext()
+	err = client.WaitForMastership(ctx)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	if deviceConfig != "" {
+		ctx, cancel := rpcContext()
+		start := time.Now()
+		pushed, err := client.UpdatePipelineConfigContext(ctx, p4InfoPath, deviceConfig, forcePush)
+		cancel()
+		if err != nil {
+			panic(err)
+		}
+		logPipelinePush(p4InfoPath, pushed, time.Since(start))
+	}
+
+	packetInChan := make(chan p4rt.PacketIn, iterations)
+	client.SubscribePackets(helper, packetInChan)
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(packetPort))
+	packets := make([]*p4v1.PacketOut, iterations)
+	for i := range packets {
+		packets[i], err = helper.EncodePacketOut(buildTestPacket(uint32(i), packetSize), map[string][]byte{
+			packetPortMetadata: port,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Send as fast as the stream allows, remembering when each packet left
+	sent := make([]time.Time, iterations)
+	var failed int
+	start := time.Now()
+	for i, packet := range packets {
+		sent[i] = time.Now()
+		if err := client.SendPacketOut(packet); err != nil {
+			fmt.Printf("packet-out error: %v\n", err)
+			failed++
+		}
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Sent %d packet-outs (%d failed) in %v: %.1f packets/sec\n",
+		iterations, failed, elapsed, float64(iterations)/elapsed.Seconds())
+
+	// Wait for the packets to come back, giving the switch -duration after the last one
+	rtts := make([]time.Duration, iterations)
+	var received, duplicate, unknown int
+	deadline := time.After(duration)
+	for waiting := true; waiting && received < iterations-failed; {
+		select {
+		case packetIn := <-packetInChan:
+			seq, ok := parseTestPacket(packetIn.Payload)
+			if !ok || int(seq) >= iterations {
+				unknown++
+				continue
+			}
+			if rtts[seq] != 0 {
+				duplicate++
+				continue
+			}
+			rtts[seq] = packetIn.Received.Sub(sent[seq])
+			received++
+		case <-deadline:
+			waiting = false
+		}
+	}
+
+	var measured []time.Duration
+	for _, rtt := range rtts {
+		if rtt != 0 {
+			measured = append(measured, rtt)
+		}
+	}
+	fmt.Printf("Packet-ins received: %d, lost: %d, duplicate: %d, unknown: %d\n",
+		received, iterations-received, duplicate, unknown)
+	fmt.Printf("Round trip time: %v\n", summarize(measured))
+	logP4RuntimeStreamStats(client.StreamStats())
+	fmt.Printf("Number of stream errors: %v\n", &streamErrors)
+
+	fileName := fmt.Sprintf("packet-result-%d-%d-%d.csv", iterations, packetSize, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	defer writer.Flush()
+	writer.Write([]string{"Sequence number", "µs/round trip"})
+	for seq, rtt := range rtts {
+		value := "" // lost
+		if rtt != 0 {
+			value = strconv.FormatInt(rtt.Microseconds(), 10)
+		}
+		writer.Write([]string{strconv.Itoa(seq), value})
+	}
+}
+
+// buildTestPacket returns a broadcast Ethernet frame of size bytes carrying seq
+// right after the ethertype.
+func buildTestPacket(seq uint32, size int) []byte {
+	if size < 18 {
+		size = 18
+	}
+	packet := make([]byte, size)
+	copy(packet[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(packet[6:12], []byte{0x02, 0, 0, 0, 0, 0x01})
+	binary.BigEndian.PutUint16(packet[12:14], packetEthertype)
+	binary.BigEndian.PutUint32(packet[14:18], seq)
+	return packet
+}
+
+// parseTestPacket returns the sequence number of a packet built by buildTestPacket.
+func parseTestPacket(packet []byte) (seq uint32, ok bool) {
+	if len(packet) < 18 || binary.BigEndian.Uint16(packet[12:14]) != packetEthertype {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[14:18]), true
+}
@@ -0,0 +1,92 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/proto/go/p4"
+)
+
+// runPipelineBenchmark pushes the program compiled into -buildDir with each of
+// -pipelineActions in turn, -iterations times, and measures how long the switch takes
+// to answer each action and, for warm init, to report that it finished.
+func runPipelineBenchmark() {
+	if buildDir == "" {
+		panic(fmt.Errorf("the pipeline test needs a -buildDir"))
+	}
+	program, err := bfrt.LoadProgram(buildDir, p4Name)
+	if err != nil {
+		panic(err)
+	}
+	var actions []p4.SetForwardingPipelineConfigRequest_Action
+	for _, name := range strings.Split(pipelineActions, ",") {
+		action, err := bfrt.ParsePipelineAction(strings.TrimSpace(name))
+		if err != nil {
+			panic(err)
+		}
+		actions = append(actions, action)
+	}
+	fmt.Printf("Program %s: %d profiles, %d bytes\n", program.P4Name, len(program.Profiles), program.Size())
+
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     program.P4Name,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+	defer client.Close()
+	client.SetPipelineBasePath(basePath)
+
+	responses := make(map[p4.SetForwardingPipelineConfigRequest_Action][]time.Duration)
+	completions := make(map[p4.SetForwardingPipelineConfigRequest_Action][]time.Duration)
+	var rows [][]string
+	var failed int
+	for i := 0; i < iterations; i++ {
+		for _, action := range actions {
+			ctx, cancel := rpcContext()
+			push, err := client.PushPipelineConfigContext(ctx, action, program)
+			cancel()
+			if err != nil {
+				fmt.Printf("%v failed: %v\n", action, err)
+				failed++
+				rows = append(rows, []string{strconv.Itoa(i), action.String(), "", "", err.Error()})
+				continue
+			}
+			responses[action] = append(responses[action], push.Response)
+			completions[action] = append(completions[action], push.Done)
+			rows = append(rows, []string{strconv.Itoa(i), action.String(),
+				strconv.FormatInt(push.Response.Microseconds(), 10), strconv.FormatInt(push.Done.Microseconds(), 10), ""})
+		}
+	}
+
+	// Completion differs from the response only for warm init actions
+	for _, action := range actions {
+		fmt.Printf("%v response: %v\n", action, summarize(responses[action]))
+		fmt.Printf("%v completion: %v\n", action, summarize(completions[action]))
+	}
+	fmt.Printf("Number of failed actions: %d\n", failed)
+
+	fileName := fmt.Sprintf("pipeline-result-%s-%d-%d.csv", program.P4Name, iterations, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	defer writer.Flush()
+	writer.Write([]string{"Iteration", "Action", "µs/response", "µs/completion", "Error"})
+	writer.WriteAll(rows)
+}
@@ -0,0 +1,248 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/P4Networking/bfrt-perf/p4rt"
+	"github.com/P4Networking/proto/go/p4"
+	"github.com/golang/protobuf/proto"
+	p4v1 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// pushProgram pushes one pipeline and probes it with a table write.
+type pushProgram struct {
+	name    string
+	size    int // bytes of the pipeline sent to the switch
+	push    func(ctx context.Context) (time.Duration, error)
+	insert  func() error // writes the probe entry
+	cleanup func()       // deletes the probe entry
+}
+
+// pushTarget pushes pipelines through one API.
+type pushTarget struct {
+	programs []pushProgram
+	close    func() error
+}
+
+// runPushBenchmark pushes the programs in turn, -iterations times in total, and
+// measures how long each push takes and how long after it the first table write
+// succeeds, retrying the write every -retryInterval for up to -pushWriteTimeout.
+func runPushBenchmark() {
+	var t pushTarget
+	switch api {
+	case "bfrt":
+		t = bfrtPushTarget()
+	case "p4rt":
+		t = p4rtPushTarget()
+	default:
+		panic(fmt.Errorf("unknown API %q", api))
+	}
+	defer t.close()
+	for _, program := range t.programs {
+		fmt.Printf("Program %s: %d bytes\n", program.name, program.size)
+	}
+	fmt.Printf("Pushing %d programs in turn, %d times\n", len(t.programs), iterations)
+
+	var pushes, firstWrites, totals []time.Duration
+	var failed, timedOut int
+	var rows [][]string
+	for i := 0; i < iterations; i++ {
+		program := t.programs[i%len(t.programs)]
+		row := []string{strconv.Itoa(i), program.name, strconv.Itoa(program.size)}
+		ctx, cancel := rpcContext()
+		pushTime, err := program.push(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("push %d of %s failed: %v\n", i, program.name, err)
+			failed++
+			rows = append(rows, append(row, "", "", "", err.Error()))
+			continue
+		}
+		pushes = append(pushes, pushTime)
+
+		pushed := time.Now()
+		attempts := 0
+		for {
+			attempts++
+			err = program.insert()
+			if err == nil || time.Since(pushed) > pushWriteTimeout {
+				break
+			}
+			time.Sleep(retryInterval)
+		}
+		if err != nil {
+			fmt.Printf("no write succeeded within %v of push %d of %s: %v\n", pushWriteTimeout, i, program.name, err)
+			timedOut++
+			rows = append(rows, append(row, strconv.FormatInt(pushTime.Microseconds(), 10), "", strconv.Itoa(attempts), err.Error()))
+			continue
+		}
+		firstWrite := time.Since(pushed)
+		firstWrites = append(firstWrites, firstWrite)
+		totals = append(totals, pushTime+firstWrite)
+		rows = append(rows, append(row, strconv.FormatInt(pushTime.Microseconds(), 10),
+			strconv.FormatInt(firstWrite.Microseconds(), 10), strconv.Itoa(attempts), ""))
+		program.cleanup()
+	}
+
+	fmt.Printf("Push latency: %v\n", summarize(pushes))
+	fmt.Printf("Time from push to first successful write: %v\n", summarize(firstWrites))
+	fmt.Printf("Push until writable: %v\n", summarize(totals))
+	fmt.Printf("Number of failed pushes: %d\n", failed)
+	fmt.Printf("Number of pushes without a successful write: %d\n", timedOut)
+
+	fileName := fmt.Sprintf("push-result-%s-%d-%d-%d.csv", api, len(t.programs), iterations, time.Now().Unix())
+	fmt.Printf("Saving results to %s\n", fileName)
+	csvFile, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	writer := csv.NewWriter(csvFile)
+	defer writer.Flush()
+	writer.Write([]string{"Iteration", "Program", "Bytes", "µs/push", "µs/first write", "Write attempts", "Error"})
+	writer.WriteAll(rows)
+}
+
+// pushProgramList returns the programs listed by -pushPrograms, or def if it is empty.
+func pushProgramList(def string) []string {
+	if pushPrograms == "" {
+		return []string{def}
+	}
+	return strings.Split(pushPrograms, ";")
+}
+
+// bfrtPushTarget pushes the programs in -pushPrograms, or in -buildDir, with warm
+// init, and probes each with the first entry of the write test.
+func bfrtPushTarget() pushTarget {
+	if buildDir == "" && pushPrograms == "" {
+		panic(fmt.Errorf("the push test needs a -buildDir or -pushPrograms with -api bfrt"))
+	}
+	var programs []*bfrt.Program
+	for _, dir := range pushProgramList(buildDir) {
+		program, err := bfrt.LoadProgram(dir, p4Name)
+		if err != nil {
+			panic(err)
+		}
+		programs = append(programs, program)
+	}
+	client := connectBFRuntime(bfrt.ClientOptions{
+		Host:       target,
+		DeviceId:   deviceId,
+		ClientId:   clientId,
+		P4Name:     programs[0].P4Name,
+		BatchSize:  1,
+		NumThreads: 1,
+	})
+	client.SetPipelineBasePath(basePath)
+	write := func(req *p4.WriteRequest) error {
+		p4Err := (<-client.Write(req))[0]
+		if code := codes.Code(p4Err.GetCanonicalCode()); code != codes.OK {
+			return fmt.Errorf("%v: %s", code, p4Err.GetMessage())
+		}
+		return nil
+	}
+
+	t := pushTarget{close: client.Close}
+	for _, program := range programs {
+		program := program
+		// IDs differ between programs, so each probe is built from its own bfrt.json
+		err := p4infoHelper.Init(program.BfruntimeInfo)
+		if err != nil {
+			panic(err)
+		}
+		insert := BuildTableEntries(client, 1, 1)[0]
+		remove := proto.Clone(insert).(*p4.WriteRequest)
+		remove.Updates[0].Type = p4.Update_DELETE
+		t.programs = append(t.programs, pushProgram{
+			name: program.P4Name,
+			size: program.Size(),
+			push: func(ctx context.Context) (time.Duration, error) {
+				push, err := client.PushPipelineConfigContext(ctx, p4.SetForwardingPipelineConfigRequest_VERIFY_AND_WARM_INIT_BEGIN_AND_END, program)
+				return push.Done, err
+			},
+			insert:  func() error { return write(insert) },
+			cleanup: func() { write(remove) },
+		})
+	}
+	return t
+}
+
+// p4rtPushTarget pushes the P4Info and device config pairs in -pushPrograms, or
+// -p4info and -deviceConfig, and probes each with the first entry of the P4Runtime
+// write test.
+func p4rtPushTarget() pushTarget {
+	if (p4InfoPath == "" || deviceConfig == "") && pushPrograms == "" {
+		panic(fmt.Errorf("the push test needs a -p4info and a -deviceConfig, or -pushPrograms, with -api p4rt"))
+	}
+	client := connectP4Runtime(p4rt.ClientOptions{
+		Host:               target,
+		DeviceID:           uint64(deviceId),
+		RoleID:             roleId,
+		DeviceConfigTarget: deviceTarget,
+		BatchSize:          1,
+		NumThreads:         1,
+	}, 1)
+	ctx, cancel := rpcContext()
+	err := client.WaitForMastership(ctx)
+	cancel()
+	if err != nil {
+		panic(err)
+	}
+	write := func(req *p4v1.WriteRequest) error {
+		p4Err := (<-client.Write(req))[0]
+		if code := codes.Code(p4Err.GetCanonicalCode()); code != codes.OK {
+			return fmt.Errorf("%v: %s", code, p4Err.GetMessage())
+		}
+		return nil
+	}
+
+	t := pushTarget{close: client.Close}
+	for _, program := range pushProgramList(p4InfoPath + "," + deviceConfig) {
+		// The device config may itself contain commas, e.g. for stratum_bf
+		paths := strings.SplitN(program, ",", 2)
+		if len(paths) != 2 {
+			panic(fmt.Errorf("push program %q is not <p4info>,<deviceConfig>", program))
+		}
+		helper := &p4rt.P4InfoHelper{}
+		err := helper.Init(paths[0])
+		if err != nil {
+			panic(err)
+		}
+		p4info, err := p4rt.LoadP4Info(paths[0])
+		if err != nil {
+			panic(err)
+		}
+		pipeline, err := p4rt.BuildPipelineConfig(p4info, deviceTarget, paths[1])
+		if err != nil {
+			panic(err)
+		}
+		insert := BuildP4RuntimeTableEntries(client, helper, 1, 1)[0]
+		remove := proto.Clone(insert).(*p4v1.WriteRequest)
+		remove.Updates[0].Type = p4v1.Update_DELETE
+		t.programs = append(t.programs, pushProgram{
+			name: paths[1],
+			size: len(pipeline.P4DeviceConfig),
+			push: func(ctx context.Context) (time.Duration, error) {
+				start := time.Now()
+				err := client.PushPipelineConfigContext(ctx, &pipeline)
+				return time.Since(start), err
+			},
+			insert:  func() error { return write(insert) },
+			cleanup: func() { write(remove) },
+		})
+	}
+	return t
+}
@@ -0,0 +1,386 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MRT record types and subtypes of RIB dumps (RFC 6396)
+const (
+	mrtTableDump          = 12
+	mrtTableDumpV2        = 13
+	mrtTableDumpIPv4      = 1
+	mrtTableDumpIPv6      = 2
+	mrtRIBIPv4Unicast     = 2
+	mrtRIBIPv6Unicast     = 4
+	mrtHeaderLength       = 12
+	bgpAttrExtendedLength = 0x10
+	bgpAttrNextHop        = 3
+	bgpAttrMPReachNLRI    = 14
+)
+
+// route is a prefix and the next hop it is routed to, if known.
+type route struct {
+	prefix  net.IP
+	length  int
+	nextHop net.IP
+}
+
+func (r route) String() string {
+	return fmt.Sprintf("%v/%d", r.prefix, r.length)
+}
+
+var (
+	routesOnce     sync.Once
+	routes         []route
+	routesErr      error
+	routesNextHops map[string]int // next hop to its index, from 1 in order of appearance
+)
+
+// importedRoutes loads -routes once, keeping a random sample of -routeSample routes
+// if set.
+func importedRoutes() ([]route, error) {
+	routesOnce.Do(func() {
+		routes, routesErr = loadRoutes(routesPath, routeFormat)
+		if routesErr != nil {
+			return
+		}
+		if routeSample > 0 && routeSample < len(routes) {
+			routes = sampleRoutes(routes, routeSample)
+		}
+		routesNextHops = make(map[string]int)
+		for _, r := range routes {
+			if _, ok := routesNextHops[r.nextHop.String()]; !ok {
+				routesNextHops[r.nextHop.String()] = len(routesNextHops) + 1
+			}
+		}
+		fmt.Printf("Routes from %s: %d prefixes, %d next hops\n", routesPath, len(routes), len(routesNextHops))
+		fmt.Printf("Prefix lengths: %s\n", prefixLengthDistribution(routes))
+	})
+	return routes, routesErr
+}
+
+// nextHopIndex returns the index a controller would give the next hop of r.
+func nextHopIndex(r route) int {
+	return routesNextHops[r.nextHop.String()]
+}
+
+// loadRoutes reads the unique prefixes of a prefix list or an MRT RIB dump, which
+// may be compressed with gzip or bzip2. With format auto, MRT dumps are told apart
+// by the record type in their first header.
+func loadRoutes(path, format string) ([]route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(file)
+	}
+	br := bufio.NewReader(r)
+	if format == "auto" {
+		format = "text"
+		if header, _ := br.Peek(mrtHeaderLength); len(header) == mrtHeaderLength && isMRTHeader(header) {
+			format = "mrt"
+		}
+	}
+
+	var all []route
+	switch format {
+	case "text":
+		all, err = readTextRoutes(br)
+	case "mrt":
+		all, err = readMRTRoutes(br)
+	default:
+		return nil, fmt.Errorf("unknown route format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return uniqueRoutes(all), nil
+}
+
+func isMRTHeader(header []byte) bool {
+	switch binary.BigEndian.Uint16(header[4:6]) {
+	case mrtTableDump, mrtTableDumpV2:
+		return true
+	}
+	return false
+}
+
+// readTextRoutes reads one prefix per line, optionally followed by its next hop.
+// Addresses without a prefix length are host routes. Blank lines and lines starting
+// with # are skipped.
+func readTextRoutes(r io.Reader) ([]route, error) {
+	var all []route
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		prefix := fields[0]
+		if !strings.Contains(prefix, "/") {
+			if ip := net.ParseIP(prefix); ip != nil && ip.To4() != nil {
+				prefix += "/32"
+			} else {
+				prefix += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		length, _ := ipNet.Mask.Size()
+		rt := route{prefix: ipNet.IP, length: length}
+		if len(fields) > 1 {
+			rt.nextHop = net.ParseIP(fields[1])
+			if rt.nextHop == nil {
+				return nil, fmt.Errorf("line %d: invalid next hop %q", line, fields[1])
+			}
+		}
+		all = append(all, rt)
+	}
+	return all, scanner.Err()
+}
+
+// readMRTRoutes reads the prefixes of the unicast RIB records of an MRT dump, in the
+// TABLE_DUMP or TABLE_DUMP_V2 format, with the next hop of the first RIB entry of
+// each. Other records are skipped.
+func readMRTRoutes(r io.Reader) ([]route, error) {
+	var all []route
+	header := make([]byte, mrtHeaderLength)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("MRT header: %v", err)
+		}
+		recordType := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("MRT record: %v", err)
+		}
+
+		var rt route
+		var ok bool
+		switch {
+		case recordType == mrtTableDumpV2 && (subtype == mrtRIBIPv4Unicast || subtype == mrtRIBIPv6Unicast):
+			rt, ok = parseRIBRecord(body, subtype == mrtRIBIPv6Unicast)
+		case recordType == mrtTableDump && (subtype == mrtTableDumpIPv4 || subtype == mrtTableDumpIPv6):
+			rt, ok = parseTableDumpRecord(body, subtype == mrtTableDumpIPv6)
+		default:
+			continue
+		}
+		if !ok {
+			return nil, fmt.Errorf("truncated MRT record of type %d, subtype %d", recordType, subtype)
+		}
+		all = append(all, rt)
+	}
+}
+
+// parseRIBRecord parses a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record.
+func parseRIBRecord(body []byte, ipv6 bool) (rt route, ok bool) {
+	// Sequence number, then the prefix length and the prefix bytes
+	if len(body) < 5 {
+		return
+	}
+	rt.length = int(body[4])
+	prefixBytes := (rt.length + 7) / 8
+	body = body[5:]
+	if len(body) < prefixBytes+2 {
+		return
+	}
+	rt.prefix = make(net.IP, addressLength(ipv6))
+	copy(rt.prefix, body[:prefixBytes])
+	body = body[prefixBytes:]
+	entries := binary.BigEndian.Uint16(body)
+	body = body[2:]
+	if entries > 0 {
+		// Peer index and originated time, then the attributes
+		if len(body) < 8 {
+			return
+		}
+		attrLen := int(binary.BigEndian.Uint16(body[6:8]))
+		if len(body) < 8+attrLen {
+			return
+		}
+		rt.nextHop = bgpNextHop(body[8:8+attrLen], ipv6, true)
+	}
+	return rt, true
+}
+
+// parseTableDumpRecord parses a legacy TABLE_DUMP record.
+func parseTableDumpRecord(body []byte, ipv6 bool) (rt route, ok bool) {
+	n := addressLength(ipv6)
+	// View number and sequence number, then the prefix, its length, the status,
+	// the originated time, the peer address and AS and the attributes
+	attrStart := 4 + n + 1 + 1 + 4 + n + 2 + 2
+	if len(body) < attrStart {
+		return
+	}
+	rt.prefix = make(net.IP, n)
+	copy(rt.prefix, body[4:4+n])
+	rt.length = int(body[4+n])
+	attrLen := int(binary.BigEndian.Uint16(body[attrStart-2 : attrStart]))
+	if len(body) < attrStart+attrLen {
+		return
+	}
+	rt.nextHop = bgpNextHop(body[attrStart:attrStart+attrLen], ipv6, false)
+	return rt, true
+}
+
+// bgpNextHop finds the next hop in BGP path attributes: the NEXT_HOP attribute for
+// IPv4 and the MP_REACH_NLRI attribute for IPv6. TABLE_DUMP_V2 abbreviates the
+// latter to the next hop length and address.
+func bgpNextHop(attrs []byte, ipv6, abbreviated bool) net.IP {
+	for len(attrs) >= 3 {
+		flags, attrType := attrs[0], attrs[1]
+		length, start := int(attrs[2]), 3
+		if flags&bgpAttrExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return nil
+			}
+			length, start = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < start+length {
+			return nil
+		}
+		value := attrs[start : start+length]
+		attrs = attrs[start+length:]
+
+		switch {
+		case !ipv6 && attrType == bgpAttrNextHop && length == net.IPv4len:
+			return net.IP(append([]byte(nil), value...))
+		case ipv6 && attrType == bgpAttrMPReachNLRI:
+			if !abbreviated {
+				// AFI and SAFI come first
+				if len(value) < 3 {
+					return nil
+				}
+				value = value[3:]
+			}
+			// A link-local address may follow the global one
+			if len(value) < 1+net.IPv6len || int(value[0]) < net.IPv6len {
+				return nil
+			}
+			return net.IP(append([]byte(nil), value[1:1+net.IPv6len]...))
+		}
+	}
+	return nil
+}
+
+func addressLength(ipv6 bool) int {
+	if ipv6 {
+		return net.IPv6len
+	}
+	return net.IPv4len
+}
+
+// uniqueRoutes drops the host bits of each prefix and keeps the first route to
+// each prefix, as a dump may list it once per peer.
+func uniqueRoutes(all []route) []route {
+	seen := make(map[string]bool, len(all))
+	unique := all[:0]
+	for _, rt := range all {
+		rt.prefix = rt.prefix.Mask(net.CIDRMask(rt.length, len(rt.prefix)*8))
+		if rt.prefix == nil || seen[rt.String()] {
+			continue
+		}
+		seen[rt.String()] = true
+		unique = append(unique, rt)
+	}
+	return unique
+}
+
+// sampleRoutes picks n routes at random, in the order of the dump. The sample keeps
+// the prefix length distribution of the dump.
+func sampleRoutes(all []route, n int) []route {
+	picked := rand.New(rand.NewSource(1)).Perm(len(all))[:n]
+	sort.Ints(picked)
+	sample := make([]route, n)
+	for i, j := range picked {
+		sample[i] = all[j]
+	}
+	return sample
+}
+
+// prefixLengthDistribution lists the prefix lengths of routes in the format of
+// -prefixLengths, so that synthetic workloads can follow the same distribution.
+func prefixLengthDistribution(all []route) string {
+	// Prefix length counts by address length
+	counts := map[int]map[int]int{net.IPv4len: {}, net.IPv6len: {}}
+	for _, rt := range all {
+		counts[len(rt.prefix)][rt.length]++
+	}
+	var parts []string
+	for _, family := range []struct {
+		name string
+		n    int
+	}{{"IPv4", net.IPv4len}, {"IPv6", net.IPv6len}} {
+		if len(counts[family.n]) == 0 {
+			continue
+		}
+		var lengths []int
+		for length := range counts[family.n] {
+			lengths = append(lengths, length)
+		}
+		sort.Ints(lengths)
+		pairs := make([]string, len(lengths))
+		for i, length := range lengths {
+			pairs[i] = fmt.Sprintf("%d:%d", length, counts[family.n][length])
+		}
+		parts = append(parts, family.name+" "+strings.Join(pairs, ","))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// nextHopValue encodes the next hop of rt in a width-bit action parameter: its
+// address if the parameter is as wide as one, and its index otherwise.
+func nextHopValue(rt route, width int) []byte {
+	nextHop := rt.nextHop
+	if ip4 := nextHop.To4(); ip4 != nil && width == 8*net.IPv4len {
+		return ip4
+	}
+	if nextHop != nil && width == 8*len(nextHop) {
+		return nextHop
+	}
+	return fieldBytes(uint64(nextHopIndex(rt)), width)
+}
+
+// isNextHopParam reports whether the i-th action parameter, named name, holds the
+// next hop: the one named by -nextHopParam, or the first one by default.
+func isNextHopParam(i int, name string) bool {
+	if nextHopParam == "" {
+		return i == 0
+	}
+	return name == nextHopParam || lastComponent(name) == nextHopParam
+}
@@ -0,0 +1,214 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadTextRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []route
+		wantErr bool
+	}{
+		{
+			name: "prefixes and next hops",
+			text: "# comment\n10.0.0.0/8 192.0.2.1\n\n2001:db8::/32\n",
+			want: []route{
+				{prefix: net.ParseIP("10.0.0.0").To4(), length: 8, nextHop: net.ParseIP("192.0.2.1")},
+				{prefix: net.ParseIP("2001:db8::"), length: 32},
+			},
+		},
+		{
+			name: "host routes",
+			text: "192.0.2.1\n2001:db8::1\n",
+			want: []route{
+				{prefix: net.ParseIP("192.0.2.1").To4(), length: 32},
+				{prefix: net.ParseIP("2001:db8::1"), length: 128},
+			},
+		},
+		{name: "invalid prefix", text: "10.0.0.0/33\n", wantErr: true},
+		{name: "invalid next hop", text: "10.0.0.0/8 gateway\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readTextRoutes(strings.NewReader(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTextRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readTextRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mrtRecord builds an MRT record with a zero timestamp.
+func mrtRecord(recordType, subtype uint16, body []byte) []byte {
+	header := make([]byte, mrtHeaderLength)
+	binary.BigEndian.PutUint16(header[4:6], recordType)
+	binary.BigEndian.PutUint16(header[6:8], subtype)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(body)))
+	return append(header, body...)
+}
+
+// bgpAttr builds a BGP path attribute shorter than 256 bytes.
+func bgpAttr(attrType byte, value []byte) []byte {
+	return append([]byte{0x40, attrType, byte(len(value))}, value...)
+}
+
+// tableDumpBody builds a TABLE_DUMP record body for prefix with attrs.
+func tableDumpBody(prefix net.IP, length int, attrs []byte) []byte {
+	body := []byte{0, 0, 0, 1} // view and sequence numbers
+	body = append(body, prefix...)
+	body = append(body, byte(length), 1, 0, 0, 0, 0) // status and originated time
+	body = append(body, make(net.IP, len(prefix))...)
+	body = append(body, 0xfd, 0xe8, byte(len(attrs)>>8), byte(len(attrs)))
+	return append(body, attrs...)
+}
+
+// ribBody builds a TABLE_DUMP_V2 RIB record body with one entry with attrs, or no
+// entries if attrs is nil.
+func ribBody(prefix net.IP, length int, attrs []byte) []byte {
+	body := []byte{0, 0, 0, 1, byte(length)}
+	body = append(body, prefix[:(length+7)/8]...)
+	if attrs == nil {
+		return append(body, 0, 0)
+	}
+	body = append(body, 0, 1, 0, 0, 0, 0, 0, 0) // entry count, peer index and originated time
+	body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+	return append(body, attrs...)
+}
+
+func TestReadMRTRoutes(t *testing.T) {
+	v4NextHop := bgpAttr(bgpAttrNextHop, net.ParseIP("192.0.2.1").To4())
+	v6NextHop := net.ParseIP("2001:db8::1")
+	origin := bgpAttr(1, []byte{0})
+	tests := []struct {
+		name    string
+		dump    []byte
+		want    []route
+		wantErr bool
+	}{
+		{
+			name: "TABLE_DUMP",
+			dump: bytes.Join([][]byte{
+				mrtRecord(mrtTableDump, mrtTableDumpIPv4, tableDumpBody(net.ParseIP("10.0.0.0").To4(), 8, append(origin, v4NextHop...))),
+				mrtRecord(mrtTableDump, mrtTableDumpIPv6, tableDumpBody(net.ParseIP("2001:db8::"), 32,
+					bgpAttr(bgpAttrMPReachNLRI, append([]byte{0, 2, 1, 16}, v6NextHop...)))),
+			}, nil),
+			want: []route{
+				{prefix: net.ParseIP("10.0.0.0").To4(), length: 8, nextHop: net.ParseIP("192.0.2.1").To4()},
+				{prefix: net.ParseIP("2001:db8::"), length: 32, nextHop: v6NextHop},
+			},
+		},
+		{
+			name: "TABLE_DUMP_V2",
+			dump: bytes.Join([][]byte{
+				mrtRecord(mrtTableDumpV2, 1, []byte{0, 0, 0, 0, 0, 0}), // PEER_INDEX_TABLE, skipped
+				mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, ribBody(net.ParseIP("10.1.0.0").To4(), 16, v4NextHop)),
+				mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, ribBody(net.ParseIP("10.2.128.0").To4(), 17, nil)),
+				mrtRecord(mrtTableDumpV2, mrtRIBIPv6Unicast, ribBody(net.ParseIP("2001:db8:1::"), 48,
+					bgpAttr(bgpAttrMPReachNLRI, append([]byte{16}, v6NextHop...)))),
+			}, nil),
+			want: []route{
+				{prefix: net.ParseIP("10.1.0.0").To4(), length: 16, nextHop: net.ParseIP("192.0.2.1").To4()},
+				{prefix: net.ParseIP("10.2.128.0").To4(), length: 17},
+				{prefix: net.ParseIP("2001:db8:1::"), length: 48, nextHop: v6NextHop},
+			},
+		},
+		{name: "empty", dump: nil},
+		{
+			name:    "truncated header",
+			dump:    mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, nil)[:mrtHeaderLength-1],
+			wantErr: true,
+		},
+		{
+			name:    "truncated body",
+			dump:    mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, ribBody(net.ParseIP("10.1.0.0").To4(), 16, v4NextHop))[:mrtHeaderLength+8],
+			wantErr: true,
+		},
+		{
+			name:    "truncated RIB entry",
+			dump:    mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, ribBody(net.ParseIP("10.1.0.0").To4(), 16, v4NextHop)[:10]),
+			wantErr: true,
+		},
+		{
+			name:    "truncated TABLE_DUMP",
+			dump:    mrtRecord(mrtTableDump, mrtTableDumpIPv4, tableDumpBody(net.ParseIP("10.0.0.0").To4(), 8, v4NextHop)[:20]),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMRTRoutes(bytes.NewReader(tt.dump))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMRTRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readMRTRoutes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dump := bytes.Join([][]byte{
+		mrtRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, ribBody(net.ParseIP("10.1.0.0").To4(), 16, nil)),
+		// The same prefix from another peer, and with host bits set
+		mrtRecord(mrtTableDump, mrtTableDumpIPv4, tableDumpBody(net.ParseIP("10.1.0.0").To4(), 16, nil)),
+		mrtRecord(mrtTableDump, mrtTableDumpIPv4, tableDumpBody(net.ParseIP("10.1.2.3").To4(), 16, nil)),
+		mrtRecord(mrtTableDump, mrtTableDumpIPv4, tableDumpBody(net.ParseIP("10.2.0.0").To4(), 16, nil)),
+	}, nil)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(dump)
+	zw.Close()
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"rib":       dump,
+		"rib.gz":    gz.Bytes(),
+		"rib.txt":   []byte("10.1.0.0/16\n10.1.2.3/16\n10.2.0.0/16\n"),
+		"rib.empty": nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []route{
+		{prefix: net.ParseIP("10.1.0.0").To4(), length: 16},
+		{prefix: net.ParseIP("10.2.0.0").To4(), length: 16},
+	}
+	for _, name := range []string{"rib", "rib.gz", "rib.txt"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadRoutes(filepath.Join(dir, name), "auto")
+			if err != nil {
+				t.Fatalf("loadRoutes() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadRoutes() = %v, want %v", got, want)
+			}
+		})
+	}
+	if got, err := loadRoutes(filepath.Join(dir, "rib.empty"), "auto"); err != nil || len(got) != 0 {
+		t.Errorf("loadRoutes() of an empty file = %v, %v, want no routes", got, err)
+	}
+	if _, err := loadRoutes(filepath.Join(dir, "rib"), "text"); err == nil {
+		t.Error("loadRoutes() of an MRT dump as text succeeded, want an error")
+	}
+}
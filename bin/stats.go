@@ -0,0 +1,98 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencySummary describes a set of measured durations.
+type latencySummary struct {
+	Count int
+	Min   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+	// StdDev is the standard deviation of the durations
+	StdDev time.Duration
+}
+
+func summarize(durations []time.Duration) (summary latencySummary) {
+	if len(durations) == 0 {
+		return
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	summary.Count = len(sorted)
+	summary.Min = sorted[0]
+	summary.Mean = total / time.Duration(len(sorted))
+	summary.P50 = sorted[len(sorted)/2]
+	summary.P99 = sorted[len(sorted)*99/100]
+	summary.Max = sorted[len(sorted)-1]
+
+	var variance float64
+	for _, d := range sorted {
+		diff := float64(d - summary.Mean)
+		variance += diff * diff
+	}
+	summary.StdDev = time.Duration(math.Sqrt(variance / float64(len(sorted))))
+	return
+}
+
+func (s latencySummary) String() string {
+	return fmt.Sprintf("n=%d min=%v mean=%v p50=%v p99=%v max=%v stddev=%v",
+		s.Count, s.Min, s.Mean, s.P50, s.P99, s.Max, s.StdDev)
+}
+
+// errorCounts counts the errors reported on the stream by the kind of the request
+// that failed.
+type errorCounts struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+var streamErrors errorCounts
+
+func (c *errorCounts) add(requestKind string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[requestKind]++
+}
+
+func (c *errorCounts) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	kinds := make([]string, 0, len(c.counts))
+	total := 0
+	for kind, count := range c.counts {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	if total == 0 {
+		return "0"
+	}
+	sort.Strings(kinds)
+	details := make([]string, len(kinds))
+	for i, kind := range kinds {
+		details[i] = fmt.Sprintf("%s: %d", kind, c.counts[kind])
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(details, ", "))
+}
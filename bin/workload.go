@@ -0,0 +1,372 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Match types of key fields, as named by P4Runtime in lower case
+const (
+	matchExact    = "exact"
+	matchLPM      = "lpm"
+	matchTernary  = "ternary"
+	matchRange    = "range"
+	matchOptional = "optional"
+)
+
+// Highest priority given to an entry; P4Runtime priorities are positive int32
+const maxPriority = 1<<31 - 1
+
+// matchField describes a key field of a table, whichever API it comes from.
+type matchField struct {
+	name      string
+	matchType string
+	width     int
+}
+
+// fieldMatch is the value generated for a key field. Range fields match value to
+// high, ternary fields value under mask and LPM fields the first prefixLen bits of
+// value.
+type fieldMatch struct {
+	value     []byte
+	high      []byte
+	mask      []byte
+	prefixLen int
+}
+
+// wildcard reports whether the field matches any value, in which case P4Runtime
+// requires it to be left out of the entry.
+func (m fieldMatch) wildcard(field matchField) bool {
+	switch field.matchType {
+	case matchLPM:
+		return m.prefixLen == 0
+	case matchTernary:
+		return isZero(m.mask)
+	case matchRange:
+		return isZero(m.value) && bytes.Equal(m.high, bigBytes(lowBits(field.width), field.width))
+	}
+	return false
+}
+
+// weightedChoice picks values, e.g. prefix lengths, in proportion to their weights.
+type weightedChoice struct {
+	values  []int
+	weights []int
+	total   int
+}
+
+// parseWeightedChoice parses a comma-separated list of value:weight pairs, e.g.
+// "24:60,22:25,16:15". A value without a weight has a weight of 1.
+func parseWeightedChoice(s string) (weightedChoice, error) {
+	var c weightedChoice
+	if s == "" {
+		return c, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		value, err := strconv.Atoi(parts[0])
+		if err != nil || value < 0 {
+			return c, fmt.Errorf("invalid value %q in %q", parts[0], s)
+		}
+		weight := 1
+		if len(parts) == 2 {
+			weight, err = strconv.Atoi(parts[1])
+			if err != nil || weight <= 0 {
+				return c, fmt.Errorf("invalid weight %q in %q", parts[1], s)
+			}
+		}
+		c.values = append(c.values, value)
+		c.weights = append(c.weights, weight)
+		c.total += weight
+	}
+	return c, nil
+}
+
+// pick returns a value drawn from the distribution, or def if it is empty.
+func (c weightedChoice) pick(r *rand.Rand, def int) int {
+	if c.total == 0 {
+		return def
+	}
+	n := r.Intn(c.total)
+	for i, weight := range c.weights {
+		if n < weight {
+			return c.values[i]
+		}
+		n -= weight
+	}
+	return def
+}
+
+// keyWorkload generates distinct keys for the fields of a table, following the
+// -prefixLengths, -maskLengths, -rangeSize, -keyBases and -priority flags. With
+// -routes, the LPM field of the table matches the imported prefixes instead, in
+// order, and the other fields match anything or their -keyBases value.
+//
+// Each key is made of the bits each field contributes, its shape: the prefix of LPM
+// fields, the masked bits of ternary fields, the range start of range fields and
+// the whole of other fields. The k-th key of a shape spreads k over those bits, the
+// last field taking the lowest bits, and counts them from the -keyBases value of
+// each field, so keys never repeat. Keys are kept once generated, so that entry n
+// has the same key when it is deleted.
+type keyWorkload struct {
+	fields        []matchField
+	priority      bool // the table needs a priority
+	prefixLengths weightedChoice
+	maskLengths   weightedChoice
+	rangeSize     uint64
+	priorityOrder string
+	bases         []*big.Int // first value of each field; nil counts from zero
+	routes        []route
+	routeField    int // index of the field matching routes
+
+	rand       *rand.Rand
+	shapes     map[string]uint64 // number of keys generated for each shape
+	keys       [][]fieldMatch
+	priorities []int32
+}
+
+func newKeyWorkload(fields []matchField, priority bool) (*keyWorkload, error) {
+	w := &keyWorkload{
+		fields:        fields,
+		priority:      priority,
+		rangeSize:     rangeSize,
+		priorityOrder: priorityOrder,
+		rand:          rand.New(rand.NewSource(1)),
+		shapes:        make(map[string]uint64),
+	}
+	var err error
+	w.prefixLengths, err = parseWeightedChoice(prefixLengths)
+	if err != nil {
+		return nil, fmt.Errorf("-prefixLengths: %v", err)
+	}
+	w.maskLengths, err = parseWeightedChoice(maskLengths)
+	if err != nil {
+		return nil, fmt.Errorf("-maskLengths: %v", err)
+	}
+	w.bases, err = parseKeyBases(keyBases, fields)
+	if err != nil {
+		return nil, fmt.Errorf("-keyBases: %v", err)
+	}
+	if w.rangeSize == 0 {
+		return nil, fmt.Errorf("-rangeSize must be at least 1")
+	}
+	switch w.priorityOrder {
+	case "same", "increasing", "decreasing", "random":
+	default:
+		return nil, fmt.Errorf("unknown -priority %q", w.priorityOrder)
+	}
+	if routesPath != "" {
+		if err := w.useRoutes(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// useRoutes takes the keys of the single LPM field from -routes, keeping the routes
+// of the same address family as the field.
+func (w *keyWorkload) useRoutes() error {
+	w.routeField = -1
+	for i, field := range w.fields {
+		if field.matchType != matchLPM {
+			continue
+		}
+		if w.routeField >= 0 {
+			return fmt.Errorf("-routes needs a table with a single LPM field, not %s", w.fieldNames())
+		}
+		w.routeField = i
+	}
+	if w.routeField < 0 {
+		return fmt.Errorf("-routes needs a table with an LPM field, not %s", w.fieldNames())
+	}
+	width := w.fields[w.routeField].width
+	if width != 8*net.IPv4len && width != 8*net.IPv6len {
+		return fmt.Errorf("LPM field %s is %d bits wide, not an IPv4 or IPv6 address", w.fields[w.routeField].name, width)
+	}
+	all, err := importedRoutes()
+	if err != nil {
+		return err
+	}
+	for _, rt := range all {
+		if 8*len(rt.prefix) == width {
+			w.routes = append(w.routes, rt)
+		}
+	}
+	if len(w.routes) == 0 {
+		return fmt.Errorf("no %d-bit prefixes in %s", width, routesPath)
+	}
+	return nil
+}
+
+// route returns the route of entry n, if the keys come from -routes.
+func (w *keyWorkload) route(n uint64) (rt route, ok bool) {
+	if w.routes == nil || n >= uint64(len(w.routes)) {
+		return
+	}
+	return w.routes[n], true
+}
+
+// entry returns the key and priority of entry n.
+func (w *keyWorkload) entry(n uint64) ([]fieldMatch, int32, error) {
+	for uint64(len(w.keys)) <= n {
+		key, err := w.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		w.keys = append(w.keys, key)
+		w.priorities = append(w.priorities, w.nextPriority(uint64(len(w.priorities))))
+	}
+	return w.keys[n], w.priorities[n], nil
+}
+
+func (w *keyWorkload) next() ([]fieldMatch, error) {
+	if w.routes != nil {
+		return w.nextRoute()
+	}
+
+	// Draw the number of significant bits of each field
+	significant := make([]int, len(w.fields))
+	shape := make([]string, len(w.fields))
+	for i, field := range w.fields {
+		switch field.matchType {
+		case matchLPM:
+			significant[i] = clamp(w.prefixLengths.pick(w.rand, field.width), field.width)
+		case matchTernary:
+			significant[i] = clamp(w.maskLengths.pick(w.rand, field.width), field.width)
+		case matchRange:
+			significant[i] = field.width - bits.Len64(w.rangeSize-1)
+			if significant[i] < 0 {
+				return nil, fmt.Errorf("-rangeSize %d does not fit in %d-bit field %s", w.rangeSize, field.width, field.name)
+			}
+		default:
+			significant[i] = field.width
+		}
+		shape[i] = strconv.Itoa(significant[i])
+	}
+	shapeKey := strings.Join(shape, "/")
+	k := new(big.Int).SetUint64(w.shapes[shapeKey])
+	w.shapes[shapeKey]++
+
+	key := make([]fieldMatch, len(w.fields))
+	for i := len(w.fields) - 1; i >= 0; i-- {
+		field := w.fields[i]
+		v := new(big.Int).And(k, lowBits(significant[i]))
+		k.Rsh(k, uint(significant[i]))
+
+		base := w.bases[i]
+		switch field.matchType {
+		case matchLPM:
+			v = prefixKey(base, v, field.width, significant[i])
+			key[i] = fieldMatch{value: bigBytes(v, field.width), prefixLen: significant[i]}
+		case matchTernary:
+			v = prefixKey(base, v, field.width, significant[i])
+			mask := new(big.Int).Lsh(lowBits(significant[i]), uint(field.width-significant[i]))
+			key[i] = fieldMatch{value: bigBytes(v, field.width), mask: bigBytes(mask, field.width)}
+		case matchRange:
+			// Ranges do not wrap around, so they start from the base of the field
+			size := new(big.Int).SetUint64(w.rangeSize)
+			v.Mul(v, size)
+			if base != nil {
+				v.Add(v, base)
+			}
+			high := new(big.Int).Add(v, size)
+			high.Sub(high, big.NewInt(1))
+			if high.BitLen() > field.width {
+				return nil, fmt.Errorf("no more ranges of %d values in field %s", w.rangeSize, field.name)
+			}
+			key[i] = fieldMatch{value: bigBytes(v, field.width), high: bigBytes(high, field.width)}
+		default:
+			v = offsetKey(base, v, field.width)
+			key[i] = fieldMatch{value: bigBytes(v, field.width)}
+		}
+	}
+	if k.Sign() != 0 {
+		return nil, fmt.Errorf("no more distinct keys of shape %s in fields %s", shapeKey, w.fieldNames())
+	}
+	return key, nil
+}
+
+func (w *keyWorkload) nextRoute() ([]fieldMatch, error) {
+	n := len(w.keys)
+	if n >= len(w.routes) {
+		return nil, fmt.Errorf("only %d routes in %s", len(w.routes), routesPath)
+	}
+	rt := w.routes[n]
+	key := make([]fieldMatch, len(w.fields))
+	for i, field := range w.fields {
+		zero := make([]byte, (field.width+7)/8)
+		switch {
+		case i == w.routeField:
+			key[i] = fieldMatch{value: []byte(rt.prefix), prefixLen: rt.length}
+		case field.matchType == matchTernary:
+			key[i] = fieldMatch{value: zero, mask: zero}
+		case field.matchType == matchRange:
+			key[i] = fieldMatch{value: zero, high: bigBytes(lowBits(field.width), field.width)}
+		case field.matchType == matchLPM:
+			key[i] = fieldMatch{value: zero}
+		default:
+			key[i] = fieldMatch{value: bigBytes(offsetKey(w.bases[i], new(big.Int), field.width), field.width)}
+		}
+	}
+	return key, nil
+}
+
+// nextPriority returns the priority of entry n. Increasing and decreasing orders
+// make each insert land above or below every entry already in a TCAM.
+func (w *keyWorkload) nextPriority(n uint64) int32 {
+	if !w.priority {
+		return 0
+	}
+	switch w.priorityOrder {
+	case "increasing":
+		return int32(1 + n%maxPriority)
+	case "decreasing":
+		return int32(maxPriority - n%maxPriority)
+	case "random":
+		return 1 + w.rand.Int31n(maxPriority)
+	}
+	return 1
+}
+
+// logRange prints the first and last of count keys generated for table.
+func (w *keyWorkload) logRange(table string, count uint64) {
+	if count == 0 || uint64(len(w.keys)) < count {
+		return
+	}
+	fmt.Printf("Keys of %s: %s to %s\n", table, formatKey(w.fields, w.keys[0]), formatKey(w.fields, w.keys[count-1]))
+}
+
+func (w *keyWorkload) fieldNames() string {
+	names := make([]string, len(w.fields))
+	for i, field := range w.fields {
+		names[i] = field.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func clamp(n, width int) int {
+	if n > width {
+		return width
+	}
+	return n
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+// Modifications copyright (C) 2020 Chun-Ming Ou
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWeightedChoice(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    weightedChoice
+		wantErr bool
+	}{
+		{s: "", want: weightedChoice{}},
+		{s: "24", want: weightedChoice{values: []int{24}, weights: []int{1}, total: 1}},
+		{s: "24:60,22:25,16:15", want: weightedChoice{values: []int{24, 22, 16}, weights: []int{60, 25, 15}, total: 100}},
+		{s: " 24:3, 16", want: weightedChoice{values: []int{24, 16}, weights: []int{3, 1}, total: 4}},
+		{s: "x", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "24:0", wantErr: true},
+		{s: "24:x", wantErr: true},
+		{s: "24,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseWeightedChoice(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWeightedChoice(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWeightedChoice(%q) = %+v, want %+v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedChoicePick(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	if got := (weightedChoice{}).pick(r, 32); got != 32 {
+		t.Errorf("empty pick() = %d, want the default 32", got)
+	}
+	c, err := parseWeightedChoice("24:1,16:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[int]int)
+	for i := 0; i < 4000; i++ {
+		counts[c.pick(r, 32)]++
+	}
+	if len(counts) != 2 || counts[16] < 2*counts[24] {
+		t.Errorf("pick() counts = %v, want about 1000 of 24 and 3000 of 16", counts)
+	}
+}
+
+// setWorkloadFlags sets the flags read by newKeyWorkload for the rest of the test.
+func setWorkloadFlags(t *testing.T, prefixes, masks string, size uint64, bases string) {
+	saved := []interface{}{prefixLengths, maskLengths, rangeSize, keyBases, priorityOrder, routesPath}
+	t.Cleanup(func() {
+		prefixLengths, maskLengths, rangeSize, keyBases = saved[0].(string), saved[1].(string), saved[2].(uint64), saved[3].(string)
+		priorityOrder, routesPath = saved[4].(string), saved[5].(string)
+	})
+	prefixLengths, maskLengths, rangeSize, keyBases = prefixes, masks, size, bases
+	priorityOrder, routesPath = "same", ""
+}
+
+func TestKeyWorkloadNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []matchField
+		prefixes string
+		masks    string
+		size     uint64
+		bases    string
+		want     int // number of distinct keys before the workload runs out
+		wantErr  string
+	}{
+		{
+			name:    "exact",
+			fields:  []matchField{{name: "a", matchType: matchExact, width: 6}},
+			want:    64,
+			wantErr: "no more distinct keys",
+		},
+		{
+			name:     "lpm of two lengths",
+			fields:   []matchField{{name: "a", matchType: matchLPM, width: 8}},
+			prefixes: "3:1,4:1",
+			// Lengths are drawn at random, so the workload runs out of one of them
+			// before using up the other
+			want:    -1,
+			wantErr: "no more distinct keys of shape",
+		},
+		{
+			name: "ternary and exact",
+			fields: []matchField{
+				{name: "a", matchType: matchTernary, width: 16},
+				{name: "b", matchType: matchExact, width: 2},
+			},
+			masks:   "3",
+			want:    32,
+			wantErr: "no more distinct keys",
+		},
+		{
+			name:    "range",
+			fields:  []matchField{{name: "a", matchType: matchRange, width: 8}},
+			size:    16,
+			want:    16,
+			wantErr: "no more distinct keys of shape 4",
+		},
+		{
+			name:    "range from a base",
+			fields:  []matchField{{name: "a", matchType: matchRange, width: 8}},
+			size:    16,
+			bases:   "a=0x80",
+			want:    8,
+			wantErr: "no more ranges of 16 values",
+		},
+		{
+			name:    "range too large",
+			fields:  []matchField{{name: "a", matchType: matchRange, width: 8}},
+			size:    512,
+			wantErr: "does not fit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = 1
+			}
+			setWorkloadFlags(t, tt.prefixes, tt.masks, size, tt.bases)
+			w, err := newKeyWorkload(tt.fields, false)
+			if err != nil {
+				t.Fatalf("newKeyWorkload() error = %v", err)
+			}
+			seen := make(map[string]bool)
+			for {
+				key, err := w.next()
+				if err != nil {
+					if !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("next() error = %v, want %q", err, tt.wantErr)
+					}
+					break
+				}
+				s := fmt.Sprint(key)
+				if seen[s] {
+					t.Fatalf("next() repeated key %s after %d keys", formatKey(tt.fields, key), len(seen))
+				}
+				seen[s] = true
+				if len(seen) > 1000 {
+					t.Fatal("next() did not run out of keys")
+				}
+			}
+			if tt.want >= 0 && len(seen) != tt.want {
+				t.Errorf("next() returned %d keys, want %d", len(seen), tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyWorkloadBases(t *testing.T) {
+	setWorkloadFlags(t, "16", "", 1, "dst_addr=10.1.0.0,port=0xfffe")
+	fields := []matchField{
+		{name: "hdr.ipv4.dst_addr", matchType: matchLPM, width: 32},
+		{name: "port", matchType: matchExact, width: 16},
+	}
+	w, err := newKeyWorkload(fields, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last field takes the lowest bits and wraps around at the top of the field
+	want := []string{
+		"dst_addr=10.1.0.0/16 port=0xfffe",
+		"dst_addr=10.1.0.0/16 port=0xffff",
+		"dst_addr=10.1.0.0/16 port=0x0",
+	}
+	for n, s := range want {
+		key, _, err := w.entry(uint64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatKey(fields, key); got != s {
+			t.Errorf("entry(%d) = %s, want %s", n, got, s)
+		}
+	}
+	key, _, err := w.entry(1 << 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, s := formatKey(fields, key), "dst_addr=10.2.0.0/16 port=0xfffe"; got != s {
+		t.Errorf("entry(1<<16) = %s, want %s", got, s)
+	}
+}
+
+func TestFieldMatchWildcard(t *testing.T) {
+	tests := []struct {
+		name  string
+		field matchField
+		match fieldMatch
+		want  bool
+	}{
+		{"lpm /0", matchField{matchType: matchLPM, width: 32}, fieldMatch{value: make([]byte, 4)}, true},
+		{"lpm /8", matchField{matchType: matchLPM, width: 32}, fieldMatch{value: []byte{10, 0, 0, 0}, prefixLen: 8}, false},
+		{"ternary zero mask", matchField{matchType: matchTernary, width: 12}, fieldMatch{value: []byte{0, 0}, mask: []byte{0, 0}}, true},
+		{"ternary", matchField{matchType: matchTernary, width: 12}, fieldMatch{value: []byte{0, 0}, mask: []byte{0x0f, 0}}, false},
+		{"full range", matchField{matchType: matchRange, width: 12}, fieldMatch{value: []byte{0, 0}, high: []byte{0x0f, 0xff}}, true},
+		{"range from one", matchField{matchType: matchRange, width: 12}, fieldMatch{value: []byte{0, 1}, high: []byte{0x0f, 0xff}}, false},
+		{"range below the top", matchField{matchType: matchRange, width: 12}, fieldMatch{value: []byte{0, 0}, high: []byte{0x0f, 0xfe}}, false},
+		{"exact", matchField{matchType: matchExact, width: 8}, fieldMatch{value: []byte{0}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.wildcard(tt.field); got != tt.want {
+				t.Errorf("wildcard() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,108 +6,357 @@ package p4rt
 
 import (
 	"context"
-	"fmt"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/ptypes/any"
 	p4 "github.com/p4lang/p4runtime/go/p4/v1"
-	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
 )
 
-var p4rtClients = make(map[p4rtClientKey]P4RuntimeClient)
+var (
+	p4rtClientsLock sync.Mutex
+	p4rtClients     = make(map[p4rtClientKey]P4RuntimeClient)
+	// Number of users of each cached client
+	p4rtClientRefs = make(map[p4rtClientKey]int)
+	// Clients being created, so that concurrent callers share a single client
+	p4rtClientCalls = make(map[p4rtClientKey]*clientCall)
+)
+
+type clientCall struct {
+	done   chan struct{}
+	client P4RuntimeClient
+	err    error
+}
+
+// ClientOptions describes the client returned by NewP4RuntimeClient.
+type ClientOptions struct {
+	Host       string
+	DeviceID   uint64
+	RoleID     uint64   // clients for different roles are never shared; 0 is the default role
+	RoleConfig *any.Any // target-specific description of the role, sent on arbitration
+	BatchSize  int
+	NumThreads int
+	// DeviceConfigTarget names the packer of the device configs pushed by the client,
+	// one of DeviceConfigTargets()
+	DeviceConfigTarget string
+	// NoCache opens a client with its own gRPC connection, neither taken from nor
+	// added to the cache, e.g. to run several controllers against the same switch
+	NoCache bool
+}
 
 type P4RuntimeClient interface {
 	SetMastership(electionID p4.Uint128) error
+	SetMastershipContext(ctx context.Context, electionID p4.Uint128) error
 	GetForwardingPipelineConfig() (*p4.ForwardingPipelineConfig, error)
+	GetForwardingPipelineConfigContext(ctx context.Context) (*p4.ForwardingPipelineConfig, error)
+	GetDeviceConfig() (*p4.ForwardingPipelineConfig, error)
+	GetDeviceConfigContext(ctx context.Context) (*p4.ForwardingPipelineConfig, error)
 	SetForwardingPipelineConfig(p4InfoPath, deviceConfigPath string) error
+	SetForwardingPipelineConfigContext(ctx context.Context, p4InfoPath, deviceConfigPath string) error
+	PushPipelineConfigContext(ctx context.Context, pipeline *p4.ForwardingPipelineConfig) error
+	UpdatePipelineConfig(p4InfoPath, deviceConfigPath string, forcePush bool) (bool, error)
+	UpdatePipelineConfigContext(ctx context.Context, p4InfoPath, deviceConfigPath string, forcePush bool) (bool, error)
 	Write(req *p4.WriteRequest) <-chan []*p4.Error
+	WriteContext(ctx context.Context, req *p4.WriteRequest) <-chan []*p4.Error
+	IsMaster() bool
+	WaitForMastership(ctx context.Context) error
 	SetWriteTraceChan(traceChan chan WriteTrace)
+	SetEventChan(eventChan chan Event)
+	SubscribePackets(p4info *P4InfoHelper, packetInChan chan PacketIn)
+	SendPacketOut(packet *p4.PacketOut) error
+	SetStreamErrorChan(errorChan chan StreamError)
+	SetReconnectBackoff(min, max time.Duration)
+	StreamStats() []StreamStats
+	SetRPCTimeout(timeout time.Duration)
+	SetWriteTimeout(timeout time.Duration)
 	DeviceID() uint64
+	RoleID() uint64
 	ElectionID() *p4.Uint128
+	Close() error
 }
 
 type p4rtClientKey struct {
 	host     string
 	deviceID uint64
+	roleID   uint64
 }
 
 type p4rtClient struct {
 	client         p4.P4RuntimeClient
 	stream         p4.P4Runtime_StreamChannelClient
+	conn           *grpc.ClientConn
+	host           string
 	deviceID       uint64
-	electionID     p4.Uint128
+	roleID         uint64 // set once at creation, so read without locking
+	roleConfig     *any.Any
 	writes         chan p4Write
 	writeTraceChan chan WriteTrace
+	eventChan      chan Event
 	batchSize      int
 	numThreads     int
+	rpcTimeout     time.Duration // applied to unary RPCs without a deadline
+	writeTimeout   time.Duration // applied to each Write RPC without a deadline
+
+	streamErrorChan chan StreamError
+
+	deviceConfigTarget string // packer of the device configs pushed by the client
+
+	minReconnectBackoff time.Duration
+	maxReconnectBackoff time.Duration
+
+	// streamLock guards the stream, which is replaced on reconnection, and the
+	// state needed to restore the session on the new stream
+	streamLock      sync.Mutex
+	streamCancel    context.CancelFunc
+	mastershipReq   *p4.StreamMessageRequest
+	pipeline        *p4.ForwardingPipelineConfig // last pipeline pushed
+	restorePipeline bool
+	packetInfo      *P4InfoHelper
+	packetInChan    chan PacketIn
+
+	// masterLock guards the election ID, which SetMastership may change while it is
+	// in use, and the mastership the switch last reported
+	masterLock sync.Mutex
+	electionID p4.Uint128
+	master     bool
+	masterChan chan struct{} // closed while the client is master
+
+	cached       bool            // conn and client are shared through the caches
+	key          p4rtClientKey   // key of the client in the cache
+	ctx          context.Context // cancelled by Close; parent of the stream
+	cancel       context.CancelFunc
+	closeLock    sync.RWMutex // held for reading while a write is being queued
+	closed       bool
+	writers      sync.WaitGroup
+	receiverDone chan struct{}
+	dispatcher   *dispatcher // routes the messages received by receiveStream
 }
 
 func (c *p4rtClient) Init() (err error) {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	// Initialize stream for mastership and packet I/O
-	c.stream, err = c.client.StreamChannel(context.Background())
+	err = c.openStream()
 	if err != nil {
+		c.cancel()
 		return
 	}
-	go func() {
-		for {
-			res, err := c.stream.Recv()
-			if err != nil {
-				fmt.Printf("stream recv error: %v\n", err)
-			} else if arb := res.GetArbitration(); arb != nil {
-				if code.Code(arb.Status.Code) == code.Code_OK {
-					fmt.Println("client is master")
-				} else {
-					fmt.Println("client is not master")
-				}
-			} else {
-				fmt.Printf("stream recv: %v\n", res)
-			}
-
-		}
-	}()
+	c.masterChan = make(chan struct{})
+	c.receiverDone = make(chan struct{})
+	c.registerHandlers()
+	go c.receiveStream()
 
 	var writeBufferSize = c.batchSize * c.numThreads * 10
 	// Initialize Write thread
 	c.writes = make(chan p4Write, writeBufferSize)
 	for i := 0; i < c.numThreads; i++ {
+		c.writers.Add(1)
 		go c.ListenForWrites()
 	}
 
 	return
 }
 
+// Close stops accepting writes, waits for the queued writes to complete and closes the
+// stream. The gRPC connection is closed once no other client is using it. A cached
+// client is only closed when the last of its users closes it.
+func (c *p4rtClient) Close() (err error) {
+	if c.cached && !c.release() {
+		return
+	}
+
+	c.closeLock.Lock()
+	if c.closed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.writes)
+	c.closeLock.Unlock()
+
+	// Let the write threads drain the queue
+	c.writers.Wait()
+
+	c.streamLock.Lock()
+	err = c.stream.CloseSend()
+	c.streamLock.Unlock()
+	c.cancel()
+	<-c.receiverDone
+	c.dispatcher.stop()
+
+	if releaseErr := c.releaseConnection(); err == nil {
+		err = releaseErr
+	}
+	return
+}
+
+// release gives up one reference to a cached client, returning true when it was the
+// last one. The client is then removed from the cache, so it is not handed out again.
+func (c *p4rtClient) release() bool {
+	p4rtClientsLock.Lock()
+	defer p4rtClientsLock.Unlock()
+	if client, ok := p4rtClients[c.key]; !ok || client != c {
+		// Already released by its last user
+		return true
+	}
+	p4rtClientRefs[c.key]--
+	if p4rtClientRefs[c.key] > 0 {
+		return false
+	}
+	delete(p4rtClients, c.key)
+	delete(p4rtClientRefs, c.key)
+	return true
+}
+
+func (c *p4rtClient) releaseConnection() error {
+	if c.cached {
+		return ReleaseConnection(c.host)
+	}
+	return c.conn.Close()
+}
+
 func (c *p4rtClient) DeviceID() uint64 {
 	return c.deviceID
 }
 
+func (c *p4rtClient) RoleID() uint64 {
+	return c.roleID
+}
+
+// ElectionID returns a copy of the election ID last set by SetMastership.
 func (c *p4rtClient) ElectionID() *p4.Uint128 {
-	return &c.electionID
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	electionID := c.electionID
+	return &electionID
+}
+
+func (c *p4rtClient) SetRPCTimeout(timeout time.Duration) {
+	c.rpcTimeout = timeout
+}
+
+func (c *p4rtClient) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// withTimeout bounds ctx by timeout, unless ctx already has a deadline or timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func CreateOrGetP4RuntimeClient(host string, deviceID uint64, batchSize int, numThreads int) (P4RuntimeClient, error) {
+	return CreateOrGetP4RuntimeClientContext(context.Background(), host, deviceID, batchSize, numThreads)
+}
+
+// CreateOrGetP4RuntimeClientContext is like CreateOrGetP4RuntimeClient, but gives up
+// dialing the switch when ctx is done.
+func CreateOrGetP4RuntimeClientContext(ctx context.Context, host string, deviceID uint64, batchSize int, numThreads int) (P4RuntimeClient, error) {
+	return NewP4RuntimeClient(ctx, ClientOptions{
+		Host:       host,
+		DeviceID:   deviceID,
+		BatchSize:  batchSize,
+		NumThreads: numThreads,
+	})
+}
+
+// NewP4RuntimeClient returns the cached client for the host, device and role in opts,
+// creating it if needed. It is safe to call from multiple goroutines.
+// Every call must be paired with a call to Close on the returned client.
+func NewP4RuntimeClient(ctx context.Context, opts ClientOptions) (P4RuntimeClient, error) {
+	if opts.NoCache {
+		return newP4RuntimeClient(ctx, opts)
+	}
+
 	key := p4rtClientKey{
-		host:     host,
-		deviceID: deviceID,
+		host:     opts.Host,
+		deviceID: opts.DeviceID,
+		roleID:   opts.RoleID,
+	}
+
+	// First, return a P4RT client if one exists or is being created
+	p4rtClientsLock.Lock()
+	for {
+		if client, ok := p4rtClients[key]; ok {
+			p4rtClientRefs[key]++
+			p4rtClientsLock.Unlock()
+			return client, nil
+		}
+		call, ok := p4rtClientCalls[key]
+		if !ok {
+			break
+		}
+		// Another caller is creating the client; wait for it and check the cache again
+		p4rtClientsLock.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.err != nil && (!isContextError(call.err) || ctx.Err() != nil) {
+			return nil, call.err
+		}
+		// If the creator gave up on its own context, ours may still be live: create
+		// the client again
+		p4rtClientsLock.Lock()
 	}
+	call := &clientCall{done: make(chan struct{})}
+	p4rtClientCalls[key] = call
+	p4rtClientsLock.Unlock()
+
+	// Second, create a new P4RT client, reusing the gRPC connection if possible
+	call.client, call.err = newP4RuntimeClient(ctx, opts)
 
-	// First, return a P4RT client if one exists
-	if p4rtClient, ok := p4rtClients[key]; ok {
-		return p4rtClient, nil
+	p4rtClientsLock.Lock()
+	delete(p4rtClientCalls, key)
+	if call.err == nil {
+		p4rtClients[key] = call.client
+		p4rtClientRefs[key] = 1
 	}
+	p4rtClientsLock.Unlock()
+	close(call.done)
+	return call.client, call.err
+}
 
-	// Second, check to see if we can reuse the gRPC connection for a new P4RT client
-	conn, err := GetConnection(host)
+func newP4RuntimeClient(ctx context.Context, opts ClientOptions) (P4RuntimeClient, error) {
+	var conn *grpc.ClientConn
+	var err error
+	if opts.NoCache {
+		conn, err = Dial(ctx, opts.Host)
+	} else {
+		conn, err = GetConnectionContext(ctx, opts.Host)
+	}
 	if err != nil {
 		return nil, err
 	}
 	client := &p4rtClient{
 		client:     p4.NewP4RuntimeClient(conn),
-		deviceID:   deviceID,
-		batchSize:  batchSize,
-		numThreads: numThreads,
+		conn:       conn,
+		host:       opts.Host,
+		deviceID:   opts.DeviceID,
+		roleID:     opts.RoleID,
+		roleConfig: opts.RoleConfig,
+		batchSize:  opts.BatchSize,
+		numThreads: opts.NumThreads,
+
+		deviceConfigTarget: opts.DeviceConfigTarget,
+
+		minReconnectBackoff: defaultMinReconnectBackoff,
+		maxReconnectBackoff: defaultMaxReconnectBackoff,
+
+		cached: !opts.NoCache,
+		key: p4rtClientKey{
+			host:     opts.Host,
+			deviceID: opts.DeviceID,
+			roleID:   opts.RoleID,
+		},
 	}
 	err = client.Init()
 	if err != nil {
+		client.releaseConnection()
 		return nil, err
 	}
-	p4rtClients[key] = client
 	return client, nil
 }
@@ -0,0 +1,84 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeviceConfigPacker builds the P4 device config of a target from the files in
+// deviceConfigPath, in the format the target expects.
+type DeviceConfigPacker func(deviceConfigPath string) (P4DeviceConfig, error)
+
+// DeviceConfigUnpacker splits a device config of a target back into its files.
+type DeviceConfigUnpacker func(deviceConfig P4DeviceConfig) (*UnpackedDeviceConfig, error)
+
+// UnpackedDeviceConfig describes what a device config holds.
+type UnpackedDeviceConfig struct {
+	PipelineName string // empty if the format does not name the pipeline
+	Components   []DeviceConfigComponent
+}
+
+// DeviceConfigComponent is one of the files packed in a device config.
+type DeviceConfigComponent struct {
+	Name string
+	Data []byte
+}
+
+// Packers and unpackers by target name, registered by the pipeline_<target>.go files
+var (
+	deviceConfigPackers   = make(map[string]DeviceConfigPacker)
+	deviceConfigUnpackers = make(map[string]DeviceConfigUnpacker)
+)
+
+// RegisterDeviceConfigPacker makes packer available as target. It is meant to be
+// called from init functions.
+func RegisterDeviceConfigPacker(target string, packer DeviceConfigPacker) {
+	if _, exists := deviceConfigPackers[target]; exists {
+		panic(fmt.Sprintf("device config packer %s registered twice", target))
+	}
+	deviceConfigPackers[target] = packer
+}
+
+// RegisterDeviceConfigUnpacker makes unpacker available for the device configs of
+// target. It is meant to be called from init functions.
+func RegisterDeviceConfigUnpacker(target string, unpacker DeviceConfigUnpacker) {
+	if _, exists := deviceConfigUnpackers[target]; exists {
+		panic(fmt.Sprintf("device config unpacker %s registered twice", target))
+	}
+	deviceConfigUnpackers[target] = unpacker
+}
+
+// DeviceConfigTargets returns the names of the registered targets, sorted.
+func DeviceConfigTargets() []string {
+	targets := make([]string, 0, len(deviceConfigPackers))
+	for target := range deviceConfigPackers {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// LoadDeviceConfig builds the device config of target from deviceConfigPath.
+func LoadDeviceConfig(target, deviceConfigPath string) (P4DeviceConfig, error) {
+	packer, exists := deviceConfigPackers[target]
+	if !exists {
+		return nil, fmt.Errorf("Unknown device config target %q. Choose one of: %s",
+			target, strings.Join(DeviceConfigTargets(), ", "))
+	}
+	return packer(deviceConfigPath)
+}
+
+// UnpackDeviceConfig splits deviceConfig, in the format of target, into its files.
+func UnpackDeviceConfig(target string, deviceConfig P4DeviceConfig) (*UnpackedDeviceConfig, error) {
+	unpacker, exists := deviceConfigUnpackers[target]
+	if !exists {
+		return nil, fmt.Errorf("Unknown device config target %q. Choose one of: %s",
+			target, strings.Join(DeviceConfigTargets(), ", "))
+	}
+	return unpacker(deviceConfig)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType int
+
+const (
+	// StreamConnected is sent when the stream is re-established after a failure
+	StreamConnected EventType = iota
+	// StreamDisconnected is sent when the stream fails; Err holds the cause
+	StreamDisconnected
+	MastershipAcquired
+	MastershipLost
+	// PipelineRestored is sent when the pipeline is pushed again after reconnecting;
+	// Err is set if that failed
+	PipelineRestored
+)
+
+func (t EventType) String() string {
+	switch t {
+	case StreamConnected:
+		return "stream connected"
+	case StreamDisconnected:
+		return "stream disconnected"
+	case MastershipAcquired:
+		return "mastership acquired"
+	case MastershipLost:
+		return "mastership lost"
+	case PipelineRestored:
+		return "pipeline restored"
+	}
+	return fmt.Sprintf("event %d", int(t))
+}
+
+// Event is a change in the state of the client's stream, mastership or pipeline.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Err  error
+}
+
+func (c *p4rtClient) SetEventChan(eventChan chan Event) {
+	c.eventChan = eventChan
+}
+
+func (c *p4rtClient) sendEvent(eventType EventType, err error) {
+	if c.eventChan == nil {
+		return
+	}
+	event := Event{
+		Type: eventType,
+		Time: time.Now(),
+		Err:  err,
+	}
+	select {
+	case c.eventChan <- event: // put event into the channel unless it is full
+	default:
+		fmt.Println("Event channel full. Discarding event")
+	}
+}
@@ -5,19 +5,92 @@
 package p4rt
 
 import (
+	"context"
+
 	p4 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/grpc/status"
 )
 
 func (c *p4rtClient) SetMastership(electionID p4.Uint128) (err error) {
+	return c.SetMastershipContext(context.Background(), electionID)
+}
+
+// SetMastershipContext sends a master arbitration update with electionID. Stream
+// sends cannot be cancelled: if ctx is done first, it returns the context's error,
+// but the update may still be sent afterwards.
+func (c *p4rtClient) SetMastershipContext(ctx context.Context, electionID p4.Uint128) (err error) {
+	c.masterLock.Lock()
 	c.electionID = electionID
+	c.masterLock.Unlock()
+	arbitration := &p4.MasterArbitrationUpdate{
+		DeviceId:   c.deviceID,
+		ElectionId: &electionID,
+	}
+	if c.roleID != 0 || c.roleConfig != nil {
+		// Leaving the role unset selects the default, full-pipeline role
+		arbitration.Role = &p4.Role{
+			Id:     c.roleID,
+			Config: c.roleConfig,
+		}
+	}
 	mastershipReq := &p4.StreamMessageRequest{
 		Update: &p4.StreamMessageRequest_Arbitration{
-			Arbitration: &p4.MasterArbitrationUpdate{
-				DeviceId:   1,
-				ElectionId: &electionID,
-			},
+			Arbitration: arbitration,
 		},
 	}
-	err = c.stream.Send(mastershipReq)
+
+	// Remember the request, so mastership can be restored after reconnecting
+	c.streamLock.Lock()
+	c.mastershipReq = mastershipReq
+	c.streamLock.Unlock()
+
+	ctx, cancel := withTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	// Stream sends cannot be cancelled, so give up waiting on the send instead
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.send(mastershipReq)
+	}()
+	select {
+	case err = <-sent:
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	}
 	return
 }
+
+// IsMaster returns whether the switch last confirmed this client as master.
+func (c *p4rtClient) IsMaster() bool {
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	return c.master
+}
+
+// WaitForMastership blocks until the switch confirms this client as master, or ctx is done.
+func (c *p4rtClient) WaitForMastership(ctx context.Context) error {
+	c.masterLock.Lock()
+	masterChan := c.masterChan
+	c.masterLock.Unlock()
+	select {
+	case <-masterChan:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// setMaster records whether the client is master, returning true if that changed.
+func (c *p4rtClient) setMaster(master bool) bool {
+	c.masterLock.Lock()
+	defer c.masterLock.Unlock()
+	if c.master == master {
+		return false
+	}
+	c.master = master
+	if master {
+		close(c.masterChan)
+	} else {
+		c.masterChan = make(chan struct{})
+	}
+	return true
+}
@@ -10,6 +10,10 @@ import (
 
 type P4InfoHelper struct {
 	nameToP4ID	map[string]uint32  // P4 name to P4 ID.
+	packetMetadata	map[string]*p4_config.ControllerPacketMetadata  // packet_in and packet_out headers.
+	tables	map[string]*p4_config.Table  // table name to table.
+	actions	map[uint32]*p4_config.Action  // action ID to action.
+	actionProfiles	map[string]*p4_config.ActionProfile  // action profile name to action profile.
 
 }
 
@@ -33,12 +37,27 @@ func (p4infoHelper *P4InfoHelper) Init(p4InfoPath string) (err error) {
 		return
 	}
 
+	p4infoHelper.tables = make(map[string]*p4_config.Table)
 	for _, table := range p4info.Tables {
 		p4infoHelper.nameToP4ID[table.GetPreamble().Name] = table.GetPreamble().Id
+		p4infoHelper.tables[table.GetPreamble().GetName()] = table
 	}
 
+	p4infoHelper.actions = make(map[uint32]*p4_config.Action)
 	for _, action := range p4info.Actions {
 		p4infoHelper.nameToP4ID[action.GetPreamble().GetName()] = action.GetPreamble().GetId()
+		p4infoHelper.actions[action.GetPreamble().GetId()] = action
+	}
+
+	p4infoHelper.actionProfiles = make(map[string]*p4_config.ActionProfile)
+	for _, profile := range p4info.ActionProfiles {
+		p4infoHelper.nameToP4ID[profile.GetPreamble().GetName()] = profile.GetPreamble().GetId()
+		p4infoHelper.actionProfiles[profile.GetPreamble().GetName()] = profile
+	}
+
+	p4infoHelper.packetMetadata = make(map[string]*p4_config.ControllerPacketMetadata)
+	for _, metadata := range p4info.ControllerPacketMetadata {
+		p4infoHelper.packetMetadata[metadata.GetPreamble().GetName()] = metadata
 	}
 	return
 }
@@ -50,3 +69,42 @@ func (p4infoHelper *P4InfoHelper) GetP4Id(name string) (p4ID uint32, err error){
 	}
 	return
 }
+
+func (p4infoHelper *P4InfoHelper) GetTable(name string) (table *p4_config.Table, err error) {
+	table, exists := p4infoHelper.tables[name]
+	if !exists {
+		err = fmt.Errorf("Unable to find table %s", name)
+	}
+	return
+}
+
+// GetTableAction returns the action named name, if the table can use it.
+func (p4infoHelper *P4InfoHelper) GetTableAction(table *p4_config.Table, name string) (action *p4_config.Action, err error) {
+	for _, ref := range table.GetActionRefs() {
+		action := p4infoHelper.actions[ref.GetId()]
+		if action.GetPreamble().GetName() == name {
+			return action, nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find action %s in table %s", name, table.GetPreamble().GetName())
+}
+
+func (p4infoHelper *P4InfoHelper) GetAction(name string) (action *p4_config.Action, err error) {
+	id, err := p4infoHelper.GetP4Id(name)
+	if err != nil {
+		return
+	}
+	action, exists := p4infoHelper.actions[id]
+	if !exists {
+		err = fmt.Errorf("Unable to find action %s", name)
+	}
+	return
+}
+
+func (p4infoHelper *P4InfoHelper) GetActionProfile(name string) (profile *p4_config.ActionProfile, err error) {
+	profile, exists := p4infoHelper.actionProfiles[name]
+	if !exists {
+		err = fmt.Errorf("Unable to find action profile %s", name)
+	}
+	return
+}
@@ -0,0 +1,150 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"fmt"
+	"time"
+
+	p4_config "github.com/p4lang/p4runtime/go/p4/config/v1"
+	p4 "github.com/p4lang/p4runtime/go/p4/v1"
+)
+
+// Names of the controller headers carrying packet-in and packet-out metadata
+const (
+	packetInHeader  = "packet_in"
+	packetOutHeader = "packet_out"
+)
+
+// PacketIn is a packet sent to the controller, with its metadata decoded by name.
+type PacketIn struct {
+	Payload  []byte
+	Metadata map[string][]byte
+	Received time.Time
+}
+
+// SubscribePackets delivers the packets received on the stream to packetInChan,
+// with their metadata decoded using the packet_in header in p4info.
+func (c *p4rtClient) SubscribePackets(p4info *P4InfoHelper, packetInChan chan PacketIn) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	c.packetInfo = p4info
+	c.packetInChan = packetInChan
+}
+
+// SendPacketOut sends a packet on the stream. Use P4InfoHelper.EncodePacketOut to
+// set its metadata by name.
+func (c *p4rtClient) SendPacketOut(packet *p4.PacketOut) error {
+	return c.send(&p4.StreamMessageRequest{
+		Update: &p4.StreamMessageRequest_Packet{Packet: packet},
+	})
+}
+
+func (c *p4rtClient) handlePacketIn(packet *p4.PacketIn) {
+	received := time.Now()
+	c.streamLock.Lock()
+	p4info, packetInChan := c.packetInfo, c.packetInChan
+	c.streamLock.Unlock()
+
+	if packetInChan == nil {
+		return
+	}
+	packetIn, err := p4info.DecodePacketIn(packet)
+	if err != nil {
+		fmt.Printf("packet-in decode error: %v\n", err)
+		return
+	}
+	packetIn.Received = received
+	select {
+	case packetInChan <- packetIn: // put packet into the channel unless it is full
+	default:
+		fmt.Println("Packet-in channel full. Discarding packet")
+	}
+}
+
+// DecodePacketIn names the metadata of packet using the packet_in header.
+func (p4infoHelper *P4InfoHelper) DecodePacketIn(packet *p4.PacketIn) (packetIn PacketIn, err error) {
+	header, err := p4infoHelper.getPacketMetadata(packetInHeader)
+	if err != nil {
+		return
+	}
+	names := make(map[uint32]string, len(header.GetMetadata()))
+	for _, metadata := range header.GetMetadata() {
+		names[metadata.GetId()] = metadata.GetName()
+	}
+
+	packetIn = PacketIn{
+		Payload:  packet.GetPayload(),
+		Metadata: make(map[string][]byte, len(packet.GetMetadata())),
+	}
+	for _, metadata := range packet.GetMetadata() {
+		name, ok := names[metadata.GetMetadataId()]
+		if !ok {
+			err = fmt.Errorf("unknown %s metadata ID %d", packetInHeader, metadata.GetMetadataId())
+			return
+		}
+		packetIn.Metadata[name] = metadata.GetValue()
+	}
+	return
+}
+
+// EncodePacketOut builds a packet-out with metadata given by name, as defined by the
+// packet_out header. Values are in network byte order and must fit the bitwidth of
+// their metadata.
+func (p4infoHelper *P4InfoHelper) EncodePacketOut(payload []byte, metadata map[string][]byte) (*p4.PacketOut, error) {
+	header, err := p4infoHelper.getPacketMetadata(packetOutHeader)
+	if err != nil {
+		return nil, err
+	}
+	for name := range metadata {
+		if _, err := p4infoHelper.getPacketMetadataField(header, name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Metadata is sent in the order of the header
+	packet := &p4.PacketOut{Payload: payload}
+	for _, field := range header.GetMetadata() {
+		value, ok := metadata[field.GetName()]
+		if !ok {
+			continue
+		}
+		if width := int(field.GetBitwidth()); len(value)*8 > width && !leadingZeros(value, len(value)*8-width) {
+			return nil, fmt.Errorf("value of %s metadata %s does not fit in %d bits", packetOutHeader, field.GetName(), width)
+		}
+		packet.Metadata = append(packet.Metadata, &p4.PacketMetadata{
+			MetadataId: field.GetId(),
+			Value:      value,
+		})
+	}
+	return packet, nil
+}
+
+func (p4infoHelper *P4InfoHelper) getPacketMetadata(name string) (*p4_config.ControllerPacketMetadata, error) {
+	header, exists := p4infoHelper.packetMetadata[name]
+	if !exists {
+		return nil, fmt.Errorf("Unable to find controller packet metadata %s", name)
+	}
+	return header, nil
+}
+
+func (p4infoHelper *P4InfoHelper) getPacketMetadataField(header *p4_config.ControllerPacketMetadata, name string) (*p4_config.ControllerPacketMetadata_Metadata, error) {
+	for _, field := range header.GetMetadata() {
+		if field.GetName() == name {
+			return field, nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find %s metadata %s", header.GetPreamble().GetName(), name)
+}
+
+// leadingZeros reports whether the first bits of value are all zero.
+func leadingZeros(value []byte, bits int) bool {
+	for i := 0; i < bits; i++ {
+		if value[i/8]&(0x80>>(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
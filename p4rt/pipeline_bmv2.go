@@ -1,10 +1,7 @@
-// +build bmv2
 // Copyright 2020-present Brian O'Connor
 // Copyright 2020-present Open Networking Foundation
 // SPDX-License-Identifier: Apache-2.0
 
-// To include this file, use go build -tags tofino
-
 package p4rt
 
 import (
@@ -13,7 +10,12 @@ import (
 	"os"
 )
 
-func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
+func init() {
+	RegisterDeviceConfigPacker("bmv2", loadBmv2DeviceConfig)
+	RegisterDeviceConfigUnpacker("bmv2", unpackBmv2DeviceConfig)
+}
+
+func loadBmv2DeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	fmt.Printf("BMv2 JSON: %s\n", deviceConfigPath)
 
 	deviceConfig, err := os.Open(deviceConfigPath)
@@ -36,6 +38,9 @@ func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	return bin, nil
 }
 
-func TestTarget() string {
-	return "bmv2"
+// unpackBmv2DeviceConfig returns the BMv2 JSON, which is the device config itself.
+func unpackBmv2DeviceConfig(deviceConfig P4DeviceConfig) (*UnpackedDeviceConfig, error) {
+	return &UnpackedDeviceConfig{
+		Components: []DeviceConfigComponent{{Name: "bmv2.json", Data: deviceConfig}},
+	}, nil
 }
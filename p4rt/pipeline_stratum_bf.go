@@ -1,10 +1,7 @@
-// +build stratum_bf
 // Copyright 2020-present Brian O'Connor
 // Copyright 2020-present Open Networking Foundation
 // SPDX-License-Identifier: Apache-2.0
 
-// To include this file, use go build -tags tofino
-
 package p4rt
 
 import (
@@ -15,11 +12,17 @@ import (
 	"strings"
 )
 
-func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
+func init() {
+	RegisterDeviceConfigPacker("stratum_bf", loadStratumBfDeviceConfig)
+	RegisterDeviceConfigUnpacker("stratum_bf", unpackStratumBfDeviceConfig)
+}
+
+func loadStratumBfDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	paths := strings.Split(deviceConfigPath, ",")
-	if len(paths) != 2 {
+	if len(paths) != 2 && len(paths) != 3 {
 		return nil, errors.New("Device Config Path is invalid.\n\n" +
-			"For Tofino targets, you must provide a comma separated list with two file paths")
+			"For Tofino targets, you must provide a comma separated list with two file paths, " +
+			"optionally followed by the pipeconf name")
 	}
 
 	tofinoBinPath := strings.TrimSpace(paths[0])
@@ -38,6 +41,9 @@ func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	}
 
 	pipeconfName := "p4rt-go-gen"
+	if len(paths) == 3 {
+		pipeconfName = strings.TrimSpace(paths[2])
+	}
 
 	tofinoBin, err := os.Open(tofinoBinPath)
 	if err != nil {
@@ -96,6 +102,32 @@ func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	return bin, nil
 }
 
-func TestTarget() string {
-	return "stratum-bf"
+// unpackStratumBfDeviceConfig splits a device config built by loadStratumBfDeviceConfig:
+// the pipeconf name, tofino.bin and context.json, each preceded by its length.
+func unpackStratumBfDeviceConfig(deviceConfig P4DeviceConfig) (*UnpackedDeviceConfig, error) {
+	var parts [3][]byte
+	i := 0
+	for k := range parts {
+		if len(deviceConfig)-i < 4 {
+			return nil, errors.New("tofino device config is truncated")
+		}
+		partLen := int(binary.LittleEndian.Uint32(deviceConfig[i:]))
+		i += 4
+		if len(deviceConfig)-i < partLen {
+			return nil, errors.New("tofino device config is truncated")
+		}
+		parts[k] = deviceConfig[i : i+partLen]
+		i += partLen
+	}
+	if i != len(deviceConfig) {
+		return nil, fmt.Errorf("tofino device config has %d trailing bytes", len(deviceConfig)-i)
+	}
+
+	return &UnpackedDeviceConfig{
+		PipelineName: string(parts[0]),
+		Components: []DeviceConfigComponent{
+			{Name: "tofino.bin", Data: parts[1]},
+			{Name: "context.json", Data: parts[2]},
+		},
+	}, nil
 }
@@ -0,0 +1,107 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// packTofino lays out parts as loadStratumBfDeviceConfig does, each preceded by its
+// little-endian length.
+func packTofino(parts ...string) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(part)))
+		b = append(b, part...)
+	}
+	return b
+}
+
+func TestUnpackStratumBfDeviceConfig(t *testing.T) {
+	valid := packTofino("pipeconf", "\x01\x02\x03", `{}`)
+	tests := []struct {
+		name    string
+		config  []byte
+		want    *UnpackedDeviceConfig
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			config: valid,
+			want: &UnpackedDeviceConfig{
+				PipelineName: "pipeconf",
+				Components: []DeviceConfigComponent{
+					{Name: "tofino.bin", Data: []byte{1, 2, 3}},
+					{Name: "context.json", Data: []byte(`{}`)},
+				},
+			},
+		},
+		{
+			name:   "empty parts",
+			config: packTofino("", "", ""),
+			want: &UnpackedDeviceConfig{
+				Components: []DeviceConfigComponent{
+					{Name: "tofino.bin", Data: []byte{}},
+					{Name: "context.json", Data: []byte{}},
+				},
+			},
+		},
+		{name: "empty", config: nil, wantErr: "truncated"},
+		{name: "truncated length", config: valid[:len(valid)-len(`{}`)-2], wantErr: "truncated"},
+		{name: "truncated part", config: valid[:len(valid)-1], wantErr: "truncated"},
+		{name: "missing part", config: packTofino("pipeconf", "bin"), wantErr: "truncated"},
+		{name: "trailing bytes", config: append(append([]byte{}, valid...), 0, 0), wantErr: "2 trailing bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unpackStratumBfDeviceConfig(tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unpackStratumBfDeviceConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unpackStratumBfDeviceConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unpackStratumBfDeviceConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStratumBfDeviceConfig(t *testing.T) {
+	dir := t.TempDir()
+	binPath := filepath.Join(dir, "tofino.bin")
+	contextPath := filepath.Join(dir, "context.json")
+	if err := ioutil.WriteFile(binPath, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(contextPath, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadStratumBfDeviceConfig(binPath + "," + contextPath + ",my_pipeconf")
+	if err != nil {
+		t.Fatalf("loadStratumBfDeviceConfig() error = %v", err)
+	}
+	if want := packTofino("my_pipeconf", "\x01\x02\x03", `{}`); !reflect.DeepEqual([]byte(config), want) {
+		t.Errorf("loadStratumBfDeviceConfig() = % x, want % x", config, want)
+	}
+	unpacked, err := unpackStratumBfDeviceConfig(config)
+	if err != nil {
+		t.Fatalf("unpackStratumBfDeviceConfig() error = %v", err)
+	}
+	if unpacked.PipelineName != "my_pipeconf" {
+		t.Errorf("PipelineName = %q, want my_pipeconf", unpacked.PipelineName)
+	}
+}
@@ -1,19 +1,27 @@
-// +build stratum_bfrt
 // Copyright 2020-present Brian O'Connor
 // Copyright 2020-present Open Networking Foundation
 // SPDX-License-Identifier: Apache-2.0
 
-// To include this file, use go build -tags tofino
-
 package p4rt
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+	"github.com/golang/protobuf/proto"
 )
 
-func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
+func init() {
+	RegisterDeviceConfigPacker("stratum_bfrt", loadStratumBfrtDeviceConfig)
+	RegisterDeviceConfigUnpacker("stratum_bfrt", unpackStratumBfrtDeviceConfig)
+}
+
+// loadStratumBfrtDeviceConfig reads a pipeline package built beforehand, or builds
+// one if deviceConfigPath is a bf-p4c output directory.
+func loadStratumBfrtDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	deviceConfigBin, err := os.Open(deviceConfigPath)
 	if err != nil {
 		return nil, fmt.Errorf("open %s: %v", deviceConfigPath, err)
@@ -23,6 +31,9 @@ func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("stat %s: %v", deviceConfigPath, err)
 	}
+	if deviceConfigBinInfo.IsDir() {
+		return BuildStratumBfrtDeviceConfig(deviceConfigPath)
+	}
 
 	// Allocate the device config buffer
 	binLen := int(deviceConfigBinInfo.Size())
@@ -37,6 +48,175 @@ func LoadDeviceConfig(deviceConfigPath string) (P4DeviceConfig, error) {
 	return bin, nil
 }
 
-func TestTarget() string {
-	return "stratum-bfrt"
+// Field numbers of Stratum's BfPipelineConfig message and its Profile message
+const (
+	bfPipelineConfigP4Name        = 1
+	bfPipelineConfigBfruntimeInfo = 2
+	bfPipelineConfigProfiles      = 3
+
+	bfPipelineProfileName      = 1
+	bfPipelineProfileContext   = 2
+	bfPipelineProfileBinary    = 3
+	bfPipelineProfilePipeScope = 4
+)
+
+// BuildStratumBfrtDeviceConfig builds the pipeline package Stratum-BFRT expects, a
+// serialized BfPipelineConfig, from the program bf-p4c compiled into buildDir. See
+// bfrt.LoadProgram for the files buildDir must hold.
+func BuildStratumBfrtDeviceConfig(buildDir string) (P4DeviceConfig, error) {
+	program, err := bfrt.LoadProgram(buildDir, "")
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(program.BfruntimeInfo) {
+		return nil, fmt.Errorf("bf-rt.json in %s is not valid JSON", buildDir)
+	}
+	for _, profile := range program.Profiles {
+		if !json.Valid(profile.Context) {
+			return nil, fmt.Errorf("context.json of profile %s in %s is not valid JSON", profile.Name, buildDir)
+		}
+		if len(profile.Binary) == 0 {
+			return nil, fmt.Errorf("device binary of profile %s in %s is empty", profile.Name, buildDir)
+		}
+	}
+	fmt.Printf("Stratum-BFRT pipeline %s: %d profiles from %s\n", program.P4Name, len(program.Profiles), buildDir)
+	return encodeBfPipelineConfig(program), nil
+}
+
+// encodeBfPipelineConfig serializes program as a BfPipelineConfig, which is not
+// part of the protos this module depends on.
+func encodeBfPipelineConfig(program *bfrt.Program) []byte {
+	buf := proto.NewBuffer(nil)
+	encodeBytesField(buf, bfPipelineConfigP4Name, []byte(program.P4Name))
+	encodeBytesField(buf, bfPipelineConfigBfruntimeInfo, program.BfruntimeInfo)
+	for _, profile := range program.Profiles {
+		profileBuf := proto.NewBuffer(nil)
+		encodeBytesField(profileBuf, bfPipelineProfileName, []byte(profile.Name))
+		encodeBytesField(profileBuf, bfPipelineProfileContext, profile.Context)
+		encodeBytesField(profileBuf, bfPipelineProfileBinary, profile.Binary)
+		if len(profile.PipeScope) > 0 {
+			// Repeated scalars are packed in proto3
+			scopeBuf := proto.NewBuffer(nil)
+			for _, pipe := range profile.PipeScope {
+				scopeBuf.EncodeVarint(uint64(pipe))
+			}
+			encodeBytesField(profileBuf, bfPipelineProfilePipeScope, scopeBuf.Bytes())
+		}
+		buf.EncodeVarint(uint64(bfPipelineConfigProfiles)<<3 | proto.WireBytes)
+		buf.EncodeRawBytes(profileBuf.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// encodeBytesField appends a length-delimited field to buf, unless value is empty.
+func encodeBytesField(buf *proto.Buffer, field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	buf.EncodeVarint(uint64(field)<<3 | proto.WireBytes)
+	buf.EncodeRawBytes(value)
+}
+
+// unpackStratumBfrtDeviceConfig splits a pipeline package into bf-rt.json and the
+// context.json and binary of each profile.
+func unpackStratumBfrtDeviceConfig(deviceConfig P4DeviceConfig) (*UnpackedDeviceConfig, error) {
+	program, err := decodeBfPipelineConfig(deviceConfig)
+	if err != nil {
+		return nil, err
+	}
+	unpacked := &UnpackedDeviceConfig{
+		PipelineName: program.P4Name,
+		Components:   []DeviceConfigComponent{{Name: "bf-rt.json", Data: program.BfruntimeInfo}},
+	}
+	for _, profile := range program.Profiles {
+		name := profile.Name
+		if len(profile.PipeScope) > 0 {
+			name = fmt.Sprintf("%s (pipes %v)", profile.Name, profile.PipeScope)
+		}
+		unpacked.Components = append(unpacked.Components,
+			DeviceConfigComponent{Name: name + "/context.json", Data: profile.Context},
+			DeviceConfigComponent{Name: name + "/binary", Data: profile.Binary},
+		)
+	}
+	return unpacked, nil
+}
+
+// decodeBfPipelineConfig parses a serialized BfPipelineConfig, as built by
+// encodeBfPipelineConfig. Unknown fields are skipped.
+func decodeBfPipelineConfig(data []byte) (*bfrt.Program, error) {
+	program := &bfrt.Program{}
+	err := decodeFields(data, func(field int, value []byte) error {
+		switch field {
+		case bfPipelineConfigP4Name:
+			program.P4Name = string(value)
+		case bfPipelineConfigBfruntimeInfo:
+			program.BfruntimeInfo = value
+		case bfPipelineConfigProfiles:
+			profile, err := decodeBfPipelineProfile(value)
+			if err != nil {
+				return err
+			}
+			program.Profiles = append(program.Profiles, profile)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid Stratum-BFRT pipeline package: %v", err)
+	}
+	return program, nil
+}
+
+func decodeBfPipelineProfile(data []byte) (profile bfrt.Profile, err error) {
+	err = decodeFields(data, func(field int, value []byte) error {
+		switch field {
+		case bfPipelineProfileName:
+			profile.Name = string(value)
+		case bfPipelineProfileContext:
+			profile.Context = value
+		case bfPipelineProfileBinary:
+			profile.Binary = value
+		case bfPipelineProfilePipeScope:
+			scopeBuf := proto.NewBuffer(value)
+			for len(scopeBuf.Unread()) > 0 {
+				pipe, err := scopeBuf.DecodeVarint()
+				if err != nil {
+					return err
+				}
+				profile.PipeScope = append(profile.PipeScope, uint32(pipe))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// decodeFields calls handle with the number and value of each field in data. The
+// value of a varint field is passed in its encoded form, so that unpacked repeated
+// scalars can be decoded as packed ones.
+func decodeFields(data []byte, handle func(field int, value []byte) error) error {
+	buf := proto.NewBuffer(data)
+	for len(buf.Unread()) > 0 {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			return err
+		}
+		var value []byte
+		switch key & 7 {
+		case proto.WireBytes:
+			value, err = buf.DecodeRawBytes(false)
+		case proto.WireVarint:
+			var v uint64
+			v, err = buf.DecodeVarint()
+			value = proto.EncodeVarint(v)
+		default:
+			err = fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if err != nil {
+			return err
+		}
+		if err := handle(int(key>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,155 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/P4Networking/bfrt-perf/bfrt"
+)
+
+func TestEncodeBfPipelineConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		program *bfrt.Program
+		want    []byte
+	}{
+		{
+			name:    "name only",
+			program: &bfrt.Program{P4Name: "p"},
+			want:    []byte{0x0a, 1, 'p'},
+		},
+		{
+			name: "profile without pipe scope",
+			program: &bfrt.Program{
+				P4Name:        "p",
+				BfruntimeInfo: []byte("{}"),
+				Profiles:      []bfrt.Profile{{Name: "a", Context: []byte("{}"), Binary: []byte{1}}},
+			},
+			want: []byte{
+				0x0a, 1, 'p',
+				0x12, 2, '{', '}',
+				0x1a, 10,
+				0x0a, 1, 'a',
+				0x12, 2, '{', '}',
+				0x1a, 1, 1,
+			},
+		},
+		{
+			name: "profiles with packed pipe scopes",
+			program: &bfrt.Program{
+				P4Name: "p",
+				Profiles: []bfrt.Profile{
+					{Name: "a", Binary: []byte{1}, PipeScope: []uint32{0, 1}},
+					{Name: "b", Binary: []byte{2}, PipeScope: []uint32{300}},
+				},
+			},
+			want: []byte{
+				0x0a, 1, 'p',
+				0x1a, 10,
+				0x0a, 1, 'a',
+				0x1a, 1, 1,
+				0x22, 2, 0, 1,
+				0x1a, 10,
+				0x0a, 1, 'b',
+				0x1a, 1, 2,
+				0x22, 2, 0xac, 0x02,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeBfPipelineConfig(tt.program)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encodeBfPipelineConfig() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBfPipelineConfig(t *testing.T) {
+	programs := []*bfrt.Program{
+		{P4Name: "p"},
+		{
+			P4Name:        "tna_simple_router",
+			BfruntimeInfo: []byte(`{"tables": []}`),
+			Profiles: []bfrt.Profile{
+				{Name: "pipe0", Context: []byte(`{}`), Binary: []byte{0, 1, 2}, PipeScope: []uint32{0, 2}},
+				{Name: "pipe1", Context: []byte(`{"a": 1}`), Binary: []byte{3}, PipeScope: []uint32{1, 300}},
+				{Name: "all", Context: []byte(`{}`), Binary: []byte{4}},
+			},
+		},
+	}
+	for _, program := range programs {
+		t.Run(program.P4Name, func(t *testing.T) {
+			got, err := decodeBfPipelineConfig(encodeBfPipelineConfig(program))
+			if err != nil {
+				t.Fatalf("decodeBfPipelineConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, program) {
+				t.Errorf("decodeBfPipelineConfig() = %+v, want %+v", got, program)
+			}
+		})
+	}
+}
+
+func TestDecodeBfPipelineConfigErrors(t *testing.T) {
+	valid := encodeBfPipelineConfig(&bfrt.Program{
+		P4Name:   "p",
+		Profiles: []bfrt.Profile{{Name: "a", Binary: []byte{1}, PipeScope: []uint32{0, 1}}},
+	})
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "empty", data: nil},
+		{name: "unknown varint field", data: append([]byte{0x0a, 1, 'p'}, 0x28, 7)},
+		{name: "truncated profile", data: valid[:len(valid)-1], wantErr: true},
+		{name: "truncated length", data: []byte{0x0a}, wantErr: true},
+		{name: "length past the end", data: []byte{0x0a, 5, 'p'}, wantErr: true},
+		{name: "trailing key", data: append(append([]byte{}, valid...), 0x12), wantErr: true},
+		{name: "trailing group", data: append(append([]byte{}, valid...), 0x0b), wantErr: true},
+		{name: "truncated pipe scope", data: []byte{0x1a, 3, 0x22, 1, 0x80}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeBfPipelineConfig(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeBfPipelineConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnpackStratumBfrtDeviceConfig(t *testing.T) {
+	program := &bfrt.Program{
+		P4Name:        "p",
+		BfruntimeInfo: []byte(`{}`),
+		Profiles: []bfrt.Profile{
+			{Name: "a", Context: []byte(`{"a": 1}`), Binary: []byte{1}, PipeScope: []uint32{0, 1}},
+			{Name: "b", Context: []byte(`{"b": 2}`), Binary: []byte{2}},
+		},
+	}
+	got, err := unpackStratumBfrtDeviceConfig(encodeBfPipelineConfig(program))
+	if err != nil {
+		t.Fatalf("unpackStratumBfrtDeviceConfig() error = %v", err)
+	}
+	want := &UnpackedDeviceConfig{
+		PipelineName: "p",
+		Components: []DeviceConfigComponent{
+			{Name: "bf-rt.json", Data: []byte(`{}`)},
+			{Name: "a (pipes [0 1])/context.json", Data: []byte(`{"a": 1}`)},
+			{Name: "a (pipes [0 1])/binary", Data: []byte{1}},
+			{Name: "b/context.json", Data: []byte(`{"b": 2}`)},
+			{Name: "b/binary", Data: []byte{2}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unpackStratumBfrtDeviceConfig() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	p4 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMinReconnectBackoff = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 10 * time.Second
+)
+
+// SetReconnectBackoff sets the delays between attempts to re-open a failed stream,
+// doubling from min up to max. A max of zero disables reconnection.
+func (c *p4rtClient) SetReconnectBackoff(min, max time.Duration) {
+	c.minReconnectBackoff = min
+	c.maxReconnectBackoff = max
+}
+
+// openStream opens a new stream, replacing the current one.
+func (c *p4rtClient) openStream() error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	stream, err := c.client.StreamChannel(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	c.streamLock.Lock()
+	if c.streamCancel != nil {
+		c.streamCancel()
+	}
+	c.stream, c.streamCancel = stream, cancel
+	c.streamLock.Unlock()
+	return nil
+}
+
+// send sends req on the current stream.
+func (c *p4rtClient) send(req *p4.StreamMessageRequest) error {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	return c.stream.Send(req)
+}
+
+func (c *p4rtClient) receiveStream() {
+	defer close(c.receiverDone)
+	for {
+		c.streamLock.Lock()
+		stream := c.stream
+		c.streamLock.Unlock()
+
+		res, err := stream.Recv()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return // the client was closed
+			}
+			fmt.Printf("stream recv error: %v\n", err)
+			c.sendEvent(StreamDisconnected, err)
+			if c.setMaster(false) {
+				c.sendEvent(MastershipLost, err)
+			}
+			if !c.reconnect() {
+				return
+			}
+			continue
+		}
+		c.dispatcher.dispatch(res)
+	}
+}
+
+// registerHandlers routes each kind of message received on the stream to its handler.
+func (c *p4rtClient) registerHandlers() {
+	c.dispatcher = newDispatcher()
+	// Mastership changes are handled in order with stream failures
+	c.dispatcher.handle(ArbitrationMessage, 0, func(res *p4.StreamMessageResponse) {
+		c.handleArbitration(res.GetArbitration())
+	})
+	c.dispatcher.handle(PacketMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handlePacketIn(res.GetPacket())
+	})
+	c.dispatcher.handle(ErrorMessage, defaultDispatchBufferSize, func(res *p4.StreamMessageResponse) {
+		c.handleStreamError(res.GetError())
+	})
+}
+
+// StreamStats returns how many messages of each handled kind were received on the
+// stream, and how many were dropped because their handler fell behind.
+func (c *p4rtClient) StreamStats() []StreamStats {
+	return c.dispatcher.stats()
+}
+
+func (c *p4rtClient) handleArbitration(arb *p4.MasterArbitrationUpdate) {
+	if code.Code(arb.GetStatus().GetCode()) != code.Code_OK {
+		fmt.Println("client is not master")
+		if c.setMaster(false) {
+			c.sendEvent(MastershipLost, status.ErrorProto(arb.GetStatus()))
+		}
+		return
+	}
+	fmt.Println("client is master")
+	if c.setMaster(true) {
+		c.sendEvent(MastershipAcquired, nil)
+	}
+	c.streamLock.Lock()
+	restore := c.restorePipeline
+	c.restorePipeline = false
+	c.streamLock.Unlock()
+	if restore {
+		go c.repushPipeline()
+	}
+}
+
+// reconnect re-opens the stream, backing off between attempts, and arbitrates again
+// if the client had arbitrated before. It returns false if the client is closed or
+// reconnection is disabled.
+func (c *p4rtClient) reconnect() bool {
+	backoff := c.minReconnectBackoff
+	if backoff <= 0 {
+		backoff = defaultMinReconnectBackoff
+	}
+	for {
+		if c.maxReconnectBackoff <= 0 {
+			return false
+		}
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		err := c.openStream()
+		if err == nil {
+			break
+		}
+		fmt.Printf("stream reconnect error: %v\n", err)
+		backoff *= 2
+		if backoff > c.maxReconnectBackoff {
+			backoff = c.maxReconnectBackoff
+		}
+	}
+	c.sendEvent(StreamConnected, nil)
+
+	c.streamLock.Lock()
+	mastershipReq := c.mastershipReq
+	// The pipeline is checked once the switch makes us master again
+	c.restorePipeline = mastershipReq != nil && c.pipeline != nil
+	c.streamLock.Unlock()
+	if mastershipReq != nil {
+		if err := c.send(mastershipReq); err != nil {
+			fmt.Printf("stream arbitration error: %v\n", err)
+		}
+	}
+	return true
+}
+
+// repushPipeline pushes the last pipeline again, unless the device still has it.
+func (c *p4rtClient) repushPipeline() {
+	c.streamLock.Lock()
+	pipeline := c.pipeline
+	c.streamLock.Unlock()
+
+	ctx, cancel := withTimeout(c.ctx, c.rpcTimeout)
+	defer cancel()
+	actual, err := getPipelineConfig(ctx, c.client, c.deviceID)
+	if err == nil && matches(pipeline, actual) {
+		return
+	}
+	err = setPipelineConfig(ctx, c.client, c.deviceID, c.roleID, c.ElectionID(), pipeline)
+	if err != nil {
+		fmt.Printf("pipeline push error: %v\n", err)
+	}
+	c.sendEvent(PipelineRestored, err)
+}
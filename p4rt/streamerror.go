@@ -0,0 +1,77 @@
+// Copyright 2020-present Brian O'Connor
+// Copyright 2020-present Open Networking Foundation
+// SPDX-License-Identifier: Apache-2.0
+
+package p4rt
+
+import (
+	"fmt"
+	"time"
+
+	p4 "github.com/p4lang/p4runtime/go/p4/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// StreamError is a failure the switch reported asynchronously on the stream, e.g.
+// for a packet-out it could not send.
+type StreamError struct {
+	Code       codes.Code
+	Message    string
+	Space      string // space of TargetCode, e.g. the target's error codes
+	TargetCode int32
+	// Request is the stream request that failed, if the switch sent it back with the
+	// error
+	Request  *p4.StreamMessageRequest
+	Received time.Time
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("%s request failed: %s: %s", e.RequestKind(), e.Code, e.Message)
+}
+
+// RequestKind names the kind of the failed request: packet, digest_ack or unknown
+// if the request is not known.
+func (e StreamError) RequestKind() string {
+	switch e.Request.GetUpdate().(type) {
+	case *p4.StreamMessageRequest_Packet:
+		return "packet"
+	case *p4.StreamMessageRequest_DigestAck:
+		return "digest_ack"
+	default:
+		return "unknown"
+	}
+}
+
+// SetStreamErrorChan delivers the errors reported on the stream to errorChan.
+func (c *p4rtClient) SetStreamErrorChan(errorChan chan StreamError) {
+	c.streamErrorChan = errorChan
+}
+
+func (c *p4rtClient) handleStreamError(p4Err *p4.StreamError) {
+	streamErr := StreamError{
+		Code:       codes.Code(p4Err.GetCanonicalCode()),
+		Message:    p4Err.GetMessage(),
+		Space:      p4Err.GetSpace(),
+		TargetCode: p4Err.GetCode(),
+		Received:   time.Now(),
+	}
+	if details := p4Err.GetPacketOut(); details != nil {
+		streamErr.Request = &p4.StreamMessageRequest{
+			Update: &p4.StreamMessageRequest_Packet{Packet: details.GetPacketOut()},
+		}
+	} else if details := p4Err.GetDigestListAck(); details != nil {
+		streamErr.Request = &p4.StreamMessageRequest{
+			Update: &p4.StreamMessageRequest_DigestAck{DigestAck: details.GetDigestListAck()},
+		}
+	}
+	fmt.Printf("stream error: %v\n", streamErr)
+
+	if c.streamErrorChan == nil {
+		return
+	}
+	select {
+	case c.streamErrorChan <- streamErr: // put error into the channel unless it is full
+	default:
+		fmt.Println("Stream error channel full. Discarding error")
+	}
+}